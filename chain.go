@@ -0,0 +1,303 @@
+package consulresolver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/friendsofgo/errors"
+)
+
+// ChainResolver resolves a service from a chain of sources (e.g. Consul, then DNS, then a static list), trying them in order
+type ChainResolver struct {
+	// accessed atomically, and kept first for 64-bit alignment on 32-bit platforms
+	index        uint64
+	serviceName  string
+	sources      []ChainSource
+	merge        bool
+	lastSource   atomic.Value
+	mu           sync.Mutex
+	results      []*chainSourceResult // the last targets of the subscribed sources, by position
+	merged       atomic.Value         // holds a *chainMerged, once every source is subscribed and was updated
+	unsubscribes []func()
+}
+
+// subscribableResolver is implemented by resolvers notifying of changes to their targets, such as the ServiceResolver
+type subscribableResolver interface {
+	MultiResolver
+	Subscribe(fn func(TargetsChangedEvent)) (unsubscribe func())
+}
+
+// chainSourceResult holds the targets of a single source, or the reason it has none
+type chainSourceResult struct {
+	addrs []ServiceAddress
+	err   error
+}
+
+// chainMerged holds the merged targets of all the sources, or the reason there are none
+type chainMerged struct {
+	targets []chainTarget
+	err     error
+}
+
+// NewChainResolver creates a new ChainResolver
+func NewChainResolver(conf ChainResolverConfig) (*ChainResolver, error) {
+	if len(conf.Sources) == 0 {
+		return nil, errors.New("chain resolver must have at least one source")
+	}
+
+	sources := make([]ChainSource, len(conf.Sources))
+	for i, source := range conf.Sources {
+		if source.Resolver == nil {
+			return nil, errors.Errorf("source %d of chain resolver must have a resolver", i)
+		}
+		if source.Name == "" {
+			source.Name = strconv.Itoa(i)
+		}
+		sources[i] = source
+	}
+
+	if conf.ServiceName == "" {
+		conf.ServiceName = sources[0].Resolver.ServiceName()
+	}
+
+	c := &ChainResolver{
+		serviceName: conf.ServiceName,
+		sources:     sources,
+		merge:       conf.Merge,
+	}
+	if c.merge {
+		c.subscribe()
+	}
+	return c, nil
+}
+
+// ServiceName returns the service name that the resolver is looking up
+func (c *ChainResolver) ServiceName() string {
+	return c.serviceName
+}
+
+// Resolve returns an address of the service, from the first source that resolves it successfully
+func (c *ChainResolver) Resolve(ctx context.Context) (ServiceAddress, error) {
+	addr, _, err := c.ResolveWithSource(ctx)
+	return addr, err
+}
+
+// ResolveWithSource resolves an address of the service, and returns the name of the source that answered
+func (c *ChainResolver) ResolveWithSource(ctx context.Context) (ServiceAddress, string, error) {
+	if c.merge {
+		targets, err := c.resolveMerged(ctx)
+		if err != nil {
+			return ServiceAddress{}, "", err
+		}
+		t := targets[int(atomic.AddUint64(&c.index, 1)%uint64(len(targets)))]
+		c.lastSource.Store(t.source)
+		return t.address, t.source, nil
+	}
+
+	var failures []string
+	for _, source := range c.sources {
+		addr, err := c.resolveFrom(ctx, source)
+		if err == nil {
+			c.lastSource.Store(source.Name)
+			return addr, source.Name, nil
+		}
+		if ctx.Err() != nil {
+			return ServiceAddress{}, "", ctx.Err()
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", source.Name, err.Error()))
+	}
+	return ServiceAddress{}, "", c.failure(failures)
+}
+
+// ResolveAll returns the addresses of all the service's targets, from the first source that resolves them successfully,
+// or from all the sources that resolve them successfully if merging
+func (c *ChainResolver) ResolveAll(ctx context.Context) ([]ServiceAddress, error) {
+	if c.merge {
+		targets, err := c.resolveMerged(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]ServiceAddress, len(targets))
+		for i, t := range targets {
+			res[i] = t.address
+		}
+		return res, nil
+	}
+
+	var failures []string
+	for _, source := range c.sources {
+		addrs, err := c.resolveAllFrom(ctx, source)
+		if err == nil && len(addrs) > 0 {
+			c.lastSource.Store(source.Name)
+			return addrs, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == nil {
+			err = errors.New("no targets found")
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", source.Name, err.Error()))
+	}
+	return nil, c.failure(failures)
+}
+
+// LastSource returns the name of the source that answered the last successful resolution, or an empty string if there was none
+func (c *ChainResolver) LastSource() string {
+	source, _ := c.lastSource.Load().(string)
+	return source
+}
+
+// Close closes the sources' resolvers that implement io.Closer
+func (c *ChainResolver) Close() error {
+	c.mu.Lock()
+	unsubscribes := c.unsubscribes
+	c.unsubscribes = nil
+	c.mu.Unlock()
+	for _, unsubscribe := range unsubscribes {
+		unsubscribe()
+	}
+
+	var failures []string
+	for _, source := range c.sources {
+		if closer, ok := source.Resolver.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %s", source.Name, err.Error()))
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return errors.Errorf("failed closing chain sources: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+type chainTarget struct {
+	address ServiceAddress
+	source  string
+}
+
+// subscribe keeps the targets of the sources that notify of their changes, so that merged resolutions do not query
+// them on every call
+func (c *ChainResolver) subscribe() {
+	c.results = make([]*chainSourceResult, len(c.sources))
+	for i, source := range c.sources {
+		subscribable, ok := source.Resolver.(subscribableResolver)
+		if !ok {
+			continue
+		}
+		i, source := i, source
+		unsubscribe := subscribable.Subscribe(func(TargetsChangedEvent) {
+			ctx, cancel := withSourceTimeout(context.Background(), source)
+			addrs, err := subscribable.ResolveAll(ctx)
+			cancel()
+			c.updateSource(i, &chainSourceResult{addrs: addrs, err: err})
+		})
+		c.mu.Lock()
+		c.unsubscribes = append(c.unsubscribes, unsubscribe)
+		c.mu.Unlock()
+	}
+}
+
+// updateSource keeps the targets of the source at the given position, and merges the targets of all the sources
+// once every source is subscribed and was updated
+func (c *ChainResolver) updateSource(i int, result *chainSourceResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results[i] = result
+	for _, r := range c.results {
+		if r == nil {
+			return
+		}
+	}
+	targets, err := c.mergeResults(c.results)
+	c.merged.Store(&chainMerged{targets: targets, err: err})
+}
+
+// resolveMerged returns the deduplicated targets of all the sources that resolve successfully.
+// Subscribed sources contribute their last targets, while the other sources are queried.
+func (c *ChainResolver) resolveMerged(ctx context.Context) ([]chainTarget, error) {
+	if merged, ok := c.merged.Load().(*chainMerged); ok {
+		return merged.targets, merged.err
+	}
+
+	results := make([]*chainSourceResult, len(c.sources))
+	c.mu.Lock()
+	copy(results, c.results)
+	c.mu.Unlock()
+	for i, source := range c.sources {
+		if results[i] != nil {
+			continue
+		}
+		addrs, err := c.resolveAllFrom(ctx, source)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		results[i] = &chainSourceResult{addrs: addrs, err: err}
+	}
+	return c.mergeResults(results)
+}
+
+// mergeResults returns the deduplicated targets of the given results of the sources
+func (c *ChainResolver) mergeResults(results []*chainSourceResult) ([]chainTarget, error) {
+	var targets []chainTarget
+	var failures []string
+	seen := map[string]struct{}{}
+	for i, result := range results {
+		if result.err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", c.sources[i].Name, result.err.Error()))
+			continue
+		}
+		for _, addr := range result.addrs {
+			key := net.JoinHostPort(addr.Host, strconv.Itoa(addr.Port))
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			targets = append(targets, chainTarget{address: addr, source: c.sources[i].Name})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, c.failure(failures)
+	}
+	return targets, nil
+}
+
+func (c *ChainResolver) resolveFrom(ctx context.Context, source ChainSource) (ServiceAddress, error) {
+	ctx, cancel := withSourceTimeout(ctx, source)
+	defer cancel()
+	return source.Resolver.Resolve(ctx)
+}
+
+func (c *ChainResolver) resolveAllFrom(ctx context.Context, source ChainSource) ([]ServiceAddress, error) {
+	ctx, cancel := withSourceTimeout(ctx, source)
+	defer cancel()
+	if multi, ok := source.Resolver.(MultiResolver); ok {
+		return multi.ResolveAll(ctx)
+	}
+	addr, err := source.Resolver.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []ServiceAddress{addr}, nil
+}
+
+func (c *ChainResolver) failure(failures []string) error {
+	if len(failures) == 0 {
+		return errors.Errorf("no targets found for service %s in any source", c.serviceName)
+	}
+	return errors.Errorf("failed resolving service %s from all sources - %s", c.serviceName, strings.Join(failures, "; "))
+}
+
+func withSourceTimeout(ctx context.Context, source ChainSource) (context.Context, context.CancelFunc) {
+	if source.Timeout > 0 {
+		return context.WithTimeout(ctx, source.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,145 @@
+package consulresolver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingResolver never resolves, until the context is done
+type blockingResolver struct{}
+
+func (blockingResolver) Resolve(ctx context.Context) (ServiceAddress, error) {
+	<-ctx.Done()
+	return ServiceAddress{}, ctx.Err()
+}
+
+func (blockingResolver) ServiceName() string {
+	return "orders"
+}
+
+func newTestStaticResolver(t *testing.T, instances ...StaticInstance) *ServiceResolver {
+	r, err := NewStaticResolver(context.Background(), ResolverConfig{
+		ServiceSpec:  ServiceSpec{ServiceName: "orders"},
+		WaitForReady: true,
+	}, instances...)
+	require.NoError(t, err)
+	return r
+}
+
+func TestChainResolverFallsBack(t *testing.T) {
+	empty := newTestStaticResolver(t)
+	static := newTestStaticResolver(t, StaticInstance{Address: "10.0.0.1", Port: 8080})
+
+	c, err := NewChainResolver(ChainResolverConfig{
+		Sources: []ChainSource{
+			{Name: "consul", Resolver: blockingResolver{}, Timeout: 20 * time.Millisecond},
+			{Name: "empty", Resolver: empty},
+			{Name: "static", Resolver: static},
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, "orders", c.ServiceName())
+
+	addr, source, err := c.ResolveWithSource(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, ServiceAddress{Host: "10.0.0.1", Port: 8080}, addr)
+	assert.Equal(t, "static", source)
+	assert.Equal(t, "static", c.LastSource())
+
+	addrs, err := c.ResolveAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ServiceAddress{{Host: "10.0.0.1", Port: 8080}}, addrs)
+}
+
+func TestChainResolverMerge(t *testing.T) {
+	consul := newTestStaticResolver(t, StaticInstance{Address: "10.0.0.1", Port: 8080}, StaticInstance{Address: "10.0.0.2", Port: 8080})
+	legacy := newTestStaticResolver(t, StaticInstance{Address: "10.0.0.2", Port: 8080}, StaticInstance{Address: "10.0.1.1", Port: 9090})
+
+	c, err := NewChainResolver(ChainResolverConfig{
+		Sources: []ChainSource{
+			{Name: "consul", Resolver: consul},
+			{Name: "down", Resolver: blockingResolver{}, Timeout: 10 * time.Millisecond},
+			{Name: "legacy", Resolver: legacy},
+		},
+		Merge: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	addrs, err := c.ResolveAll(context.Background())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []ServiceAddress{
+		{Host: "10.0.0.1", Port: 8080},
+		{Host: "10.0.0.2", Port: 8080},
+		{Host: "10.0.1.1", Port: 9090},
+	}, addrs)
+
+	sources := map[ServiceAddress]string{}
+	for i := 0; i < 3; i++ {
+		addr, source, err := c.ResolveWithSource(context.Background())
+		require.NoError(t, err)
+		sources[addr] = source
+	}
+	assert.Equal(t, map[ServiceAddress]string{
+		{Host: "10.0.0.1", Port: 8080}: "consul",
+		{Host: "10.0.0.2", Port: 8080}: "consul",
+		{Host: "10.0.1.1", Port: 9090}: "legacy",
+	}, sources)
+}
+
+func TestChainResolverMergeSubscribed(t *testing.T) {
+	consul := newTestStaticResolver(t, StaticInstance{Address: "10.0.0.1", Port: 8080})
+	legacy := newTestStaticResolver(t, StaticInstance{Address: "10.0.1.1", Port: 9090})
+
+	c, err := NewChainResolver(ChainResolverConfig{
+		Sources: []ChainSource{{Name: "consul", Resolver: consul}, {Name: "legacy", Resolver: legacy}},
+		Merge:   true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// the targets of subscribed sources are merged once, rather than on every resolution
+	_, ok := c.merged.Load().(*chainMerged)
+	assert.True(t, ok)
+	addrs, err := c.ResolveAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ServiceAddress{{Host: "10.0.0.1", Port: 8080}, {Host: "10.0.1.1", Port: 9090}}, addrs)
+
+	// changes of the sources' targets are merged as they happen
+	consul.update(0, []*api.ServiceEntry{newTestEntry("10.0.0.2", "b", 8080)}, &api.QueryMeta{})
+	assert.Eventually(t, func() bool {
+		addrs, err := c.ResolveAll(context.Background())
+		return err == nil && assert.ObjectsAreEqual([]ServiceAddress{{Host: "10.0.0.2", Port: 8080}, {Host: "10.0.1.1", Port: 9090}}, addrs)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestChainResolverAllSourcesFail(t *testing.T) {
+	c, err := NewChainResolver(ChainResolverConfig{
+		ServiceName: "orders",
+		Sources: []ChainSource{
+			{Resolver: blockingResolver{}, Timeout: 10 * time.Millisecond},
+			{Resolver: newTestStaticResolver(t)},
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.Resolve(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "0: context deadline exceeded")
+	assert.Equal(t, "", c.LastSource())
+}
+
+func TestChainResolverConfigValidation(t *testing.T) {
+	_, err := NewChainResolver(ChainResolverConfig{})
+	assert.Error(t, err)
+
+	_, err = NewChainResolver(ChainResolverConfig{Sources: []ChainSource{{Name: "nil"}}})
+	assert.Error(t, err)
+}
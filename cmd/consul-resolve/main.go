@@ -0,0 +1,386 @@
+// Command consul-resolve resolves the instances of a service the way a ServiceResolver does,
+// printing the targets of every datacenter along with the failover decision.
+//
+// Usage:
+//
+//	consul-resolve [flags] <service>
+//
+// With -watch, the changes of the target set are streamed until interrupted.
+// With -n, N selections are simulated using the configured balancer, and their distribution is printed.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	consulresolver "github.com/AppsFlyer/go-consul-resolver"
+	"github.com/AppsFlyer/go-consul-resolver/lb"
+	"github.com/friendsofgo/errors"
+	"github.com/hashicorp/consul/api"
+)
+
+type options struct {
+	address          string
+	token            string
+	service          string
+	tags             []string
+	datacenter       string
+	fallback         []string
+	filter           string
+	balancer         string
+	preferTags       []string
+	includeUnhealthy bool
+	port             int
+	stale            bool
+	timeout          time.Duration
+	watch            bool
+	selections       int
+	verbose          bool
+}
+
+func main() {
+	opts, err := parseFlags(os.Args[1:], os.Stderr)
+	if err != nil {
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err := run(ctx, opts, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "consul-resolve:", err)
+		os.Exit(1)
+	}
+}
+
+func parseFlags(args []string, output io.Writer) (options, error) {
+	var opts options
+	var tags, fallback, preferTags string
+
+	fs := flag.NewFlagSet("consul-resolve", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.Usage = func() {
+		fmt.Fprintln(output, "Usage: consul-resolve [flags] <service>")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.address, "addr", "", "the address of the Consul agent (default: $CONSUL_HTTP_ADDR or 127.0.0.1:8500)")
+	fs.StringVar(&opts.token, "token", "", "the Consul ACL token (default: $CONSUL_HTTP_TOKEN)")
+	fs.StringVar(&tags, "tags", "", "comma separated tags the instances must have")
+	fs.StringVar(&opts.datacenter, "dc", "", "the datacenter to query with the highest priority (default: the local datacenter)")
+	fs.StringVar(&fallback, "fallback", "", "comma separated fallback datacenters, in priority order")
+	fs.StringVar(&opts.filter, "filter", "", "a Consul filter expression applied to the instances")
+	fs.StringVar(&opts.balancer, "balancer", "round-robin", "the balancer used for selections: round-robin, weighted or tag-aware")
+	fs.StringVar(&preferTags, "prefer-tags", "", "comma separated tags preferred by the tag-aware balancer, which falls back to any instance")
+	fs.BoolVar(&opts.includeUnhealthy, "include-unhealthy", false, "include instances whose health checks are not passing")
+	fs.IntVar(&opts.port, "port", 0, "override the port of the instances")
+	fs.BoolVar(&opts.stale, "stale", false, "allow any Consul server to serve the queries")
+	fs.DurationVar(&opts.timeout, "timeout", 10*time.Second, "the maximal duration to wait for the Consul responses of every datacenter")
+	fs.BoolVar(&opts.watch, "watch", false, "stream the changes of the target set until interrupted")
+	fs.IntVar(&opts.selections, "n", 0, "simulate N selections, and print their distribution")
+	fs.BoolVar(&opts.verbose, "v", false, "log the resolver's debug messages")
+
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return opts, errors.New("exactly one service name is required")
+	}
+	opts.service = fs.Arg(0)
+	opts.tags = splitList(tags)
+	opts.fallback = splitList(fallback)
+	opts.preferTags = splitList(preferTags)
+	return opts, nil
+}
+
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+func newBalancer(opts options) (consulresolver.Balancer, error) {
+	switch opts.balancer {
+	case "round-robin", "":
+		return &lb.RoundRobinLoadBalancer{}, nil
+	case "weighted":
+		return &lb.WeightedRoundRobinLoadBalancer{}, nil
+	case "tag-aware":
+		return &lb.TagAwareLoadBalancer{Tags: opts.preferTags, FallbackAllowed: true}, nil
+	default:
+		return nil, errors.Errorf("unknown balancer %q", opts.balancer)
+	}
+}
+
+func run(ctx context.Context, opts options, out io.Writer) error {
+	conf := api.DefaultConfig()
+	if opts.address != "" {
+		conf.Address = opts.address
+	}
+	if opts.token != "" {
+		conf.Token = opts.token
+	}
+	client, err := api.NewClient(conf)
+	if err != nil {
+		return errors.Wrap(err, "failed creating consul client")
+	}
+
+	balancer, err := newBalancer(opts)
+	if err != nil {
+		return err
+	}
+
+	minLevel := consulresolver.LevelWarn
+	if opts.verbose {
+		minLevel = consulresolver.LevelDebug
+	}
+	resolver, err := consulresolver.NewConsulResolver(ctx, consulresolver.ResolverConfig{
+		Logger: consulresolver.LogFnLogger{Fn: func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, format+"\n", args...)
+		}, MinLevel: minLevel},
+		ServiceSpec: consulresolver.ServiceSpec{
+			ServiceName:      opts.service,
+			ServicePort:      opts.port,
+			Tags:             opts.tags,
+			IncludeUnhealthy: opts.includeUnhealthy,
+		},
+		Balancer:            balancer,
+		Client:              client,
+		Query:               &api.QueryOptions{Filter: opts.filter},
+		Datacenter:          opts.datacenter,
+		FallbackDatacenters: opts.fallback,
+		AllowStale:          opts.stale,
+		InitTimeout:         opts.timeout,
+		WaitForReady:        true,
+	})
+	if err != nil {
+		return err
+	}
+	defer resolver.Close()
+
+	return inspect(ctx, resolver, opts, out)
+}
+
+// inspect prints the state of the ready resolver, and then simulates selections or watches it as requested
+func inspect(ctx context.Context, resolver *consulresolver.ServiceResolver, opts options, out io.Writer) error {
+	if err := resolver.WaitReady(ctx); err != nil {
+		return errors.Wrap(err, "resolver is not ready")
+	}
+
+	// the resolver is ready once any datacenter responds, so wait for the others before describing the failover decision
+	waitCtx := ctx
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+	pending := waitForDatacenters(waitCtx, resolver)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(pending) > 0 {
+		fmt.Fprintf(out, "Warning: no response yet from datacenters %s\n\n", strings.Join(pending, ", "))
+	}
+
+	// subscribe before printing the state, so that no change made in between is missed
+	var events <-chan consulresolver.TargetsChangedEvent
+	if opts.watch {
+		var unsubscribe func()
+		events, unsubscribe = subscribe(ctx, resolver)
+		defer unsubscribe()
+	}
+
+	printState(out, resolver.Debug())
+
+	if opts.selections > 0 {
+		if err := simulate(ctx, out, resolver, opts.selections); err != nil {
+			return err
+		}
+	}
+
+	if opts.watch {
+		return watch(ctx, out, events)
+	}
+	return nil
+}
+
+// waitForDatacenters waits until every datacenter of the resolver responded or failed, or the context is done,
+// and returns the names of the datacenters that did neither
+func waitForDatacenters(ctx context.Context, resolver *consulresolver.ServiceResolver) []string {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		pending := pendingDatacenters(resolver.Debug())
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return pending
+		case <-ticker.C:
+		}
+	}
+}
+
+func pendingDatacenters(info consulresolver.ResolverDebugInfo) []string {
+	failed := map[string]bool{}
+	for _, e := range info.RecentErrors {
+		failed[e.Datacenter] = true
+	}
+	var pending []string
+	for _, dc := range info.Datacenters {
+		if dc.LastSuccess == nil && !failed[dc.Name] {
+			pending = append(pending, dcName(dc.Name))
+		}
+	}
+	return pending
+}
+
+func printState(out io.Writer, info consulresolver.ResolverDebugInfo) {
+	fmt.Fprintf(out, "Service: %s\n", info.ServiceName)
+	fmt.Fprintf(out, "Balancer: %s\n", info.Balancer)
+	if info.ActiveDatacenter != nil {
+		fmt.Fprintf(out, "Active datacenter: %s\n", dcName(*info.ActiveDatacenter))
+	} else {
+		fmt.Fprintln(out, "Active datacenter: none (no datacenter has instances)")
+	}
+
+	fmt.Fprintln(out, "\nDatacenters:")
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  PRIORITY\tDATACENTER\tINSTANCES\tINDEX\tLAST CONTACT\tSTATUS")
+	for _, dc := range info.Datacenters {
+		status := "skipped"
+		switch {
+		case dc.Active:
+			status = "active"
+		case dc.LastSuccess == nil:
+			status = "no response"
+		case len(dc.Instances) == 0:
+			status = "no instances"
+		}
+		fmt.Fprintf(tw, "  %d\t%s\t%d\t%d\t%s\t%s\n", dc.Priority, dcName(dc.Name), len(dc.Instances), dc.LastIndex, dc.LastContact, status)
+	}
+	_ = tw.Flush()
+
+	for _, dc := range info.Datacenters {
+		if !dc.Active {
+			continue
+		}
+		fmt.Fprintln(out, "\nTargets:")
+		printInstances(out, dc.Instances)
+	}
+}
+
+func printInstances(out io.Writer, instances []consulresolver.InstanceDebugInfo) {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  ID\tNODE\tADDRESS\tWEIGHT\tTAGS")
+	for _, i := range instances {
+		fmt.Fprintf(tw, "  %s\t%s\t%s:%d\t%d\t%s\n", i.ID, i.Node, i.Address, i.Port, i.Weight, strings.Join(i.Tags, ","))
+	}
+	_ = tw.Flush()
+}
+
+// simulate performs n selections, and prints the number of times every address was selected
+func simulate(ctx context.Context, out io.Writer, resolver consulresolver.Resolver, n int) error {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		addr, err := resolver.Resolve(ctx)
+		if err != nil {
+			return errors.Wrap(err, "selection failed")
+		}
+		counts[fmt.Sprintf("%s:%d", addr.Host, addr.Port)]++
+	}
+
+	addrs := make([]string, 0, len(counts))
+	for addr := range counts {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		if counts[addrs[i]] != counts[addrs[j]] {
+			return counts[addrs[i]] > counts[addrs[j]]
+		}
+		return addrs[i] < addrs[j]
+	})
+
+	fmt.Fprintf(out, "\nDistribution of %d selections:\n", n)
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  ADDRESS\tSELECTIONS\tSHARE")
+	for _, addr := range addrs {
+		fmt.Fprintf(tw, "  %s\t%d\t%.1f%%\n", addr, counts[addr], 100*float64(counts[addr])/float64(n))
+	}
+	return tw.Flush()
+}
+
+// subscribe returns the changes of the resolver's target set, excluding its initial targets
+func subscribe(ctx context.Context, resolver *consulresolver.ServiceResolver) (<-chan consulresolver.TargetsChangedEvent, func()) {
+	events := make(chan consulresolver.TargetsChangedEvent, 16)
+	unsubscribe := resolver.Subscribe(func(e consulresolver.TargetsChangedEvent) {
+		if e.Reason == consulresolver.ReasonInitial {
+			return
+		}
+		select {
+		case events <- e:
+		case <-ctx.Done():
+		}
+	})
+	return events, unsubscribe
+}
+
+// watch prints every change of the resolver's target set until the context is done
+func watch(ctx context.Context, out io.Writer, events <-chan consulresolver.TargetsChangedEvent) error {
+	fmt.Fprintln(out, "\nWatching for changes...")
+	for {
+		select {
+		case e := <-events:
+			printEvent(out, e)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func printEvent(out io.Writer, e consulresolver.TargetsChangedEvent) {
+	fmt.Fprintf(out, "\n%s %s", time.Now().Format(time.RFC3339), e.Reason)
+	if e.Datacenter != e.PreviousDatacenter {
+		fmt.Fprintf(out, " %s -> %s", dcName(e.PreviousDatacenter), dcName(e.Datacenter))
+	} else {
+		fmt.Fprintf(out, " in %s", dcName(e.Datacenter))
+	}
+	fmt.Fprintf(out, ", %d targets\n", len(e.Targets))
+	for _, change := range []struct {
+		sign    string
+		entries []*api.ServiceEntry
+	}{{"+", e.Added}, {"-", e.Removed}, {"~", e.Changed}} {
+		for _, entry := range change.entries {
+			fmt.Fprintf(out, "  %s %s\n", change.sign, describe(entry))
+		}
+	}
+}
+
+func describe(e *api.ServiceEntry) string {
+	address := e.Service.Address
+	if address == "" && e.Node != nil {
+		address = e.Node.Address
+	}
+	return fmt.Sprintf("%s (%s:%d)", e.Service.ID, address, e.Service.Port)
+}
+
+func dcName(name string) string {
+	if name == "" {
+		return "(local)"
+	}
+	return name
+}
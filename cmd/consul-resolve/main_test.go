@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	consulresolver "github.com/AppsFlyer/go-consul-resolver"
+	"github.com/AppsFlyer/go-consul-resolver/lb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFlags(t *testing.T) {
+	opts, err := parseFlags([]string{"-tags", "v2, canary", "-fallback", "dc2,dc3", "-balancer", "weighted", "-n", "100", "orders"}, ioutil.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, "orders", opts.service)
+	assert.Equal(t, []string{"v2", "canary"}, opts.tags)
+	assert.Equal(t, []string{"dc2", "dc3"}, opts.fallback)
+	assert.Equal(t, 100, opts.selections)
+
+	balancer, err := newBalancer(opts)
+	require.NoError(t, err)
+	assert.IsType(t, &lb.WeightedRoundRobinLoadBalancer{}, balancer)
+
+	_, err = parseFlags([]string{"-watch"}, ioutil.Discard)
+	assert.Error(t, err)
+
+	_, err = newBalancer(options{balancer: "random"})
+	assert.Error(t, err)
+}
+
+func TestInspect(t *testing.T) {
+	resolver, err := consulresolver.NewStaticResolver(context.Background(), consulresolver.ResolverConfig{
+		ServiceSpec:         consulresolver.ServiceSpec{ServiceName: "orders"},
+		Balancer:            &lb.WeightedRoundRobinLoadBalancer{},
+		FallbackDatacenters: []string{"dc2"},
+	},
+		consulresolver.StaticInstance{Address: "10.0.0.1", Port: 8080, Weight: 3, Datacenter: "dc2"},
+		consulresolver.StaticInstance{Address: "10.0.0.2", Port: 8080, Weight: 1, Datacenter: "dc2"},
+	)
+	require.NoError(t, err)
+	defer resolver.Close()
+
+	var out bytes.Buffer
+	require.NoError(t, inspect(context.Background(), resolver, options{selections: 100}, &out))
+
+	assert.Contains(t, out.String(), "Active datacenter: dc2")
+	assert.Regexp(t, `0\s+\(local\)\s+0\s+\d+\s+\S*\s+no instances`, out.String())
+	assert.Regexp(t, `1\s+dc2\s+2\s+\d+\s+\S*\s+active`, out.String())
+	assert.Regexp(t, `10\.0\.0\.1:8080\s+75\s+75\.0%`, out.String())
+	assert.Regexp(t, `10\.0\.0\.2:8080\s+25\s+25\.0%`, out.String())
+}
+
+func TestPendingDatacenters(t *testing.T) {
+	now := time.Now()
+	info := consulresolver.ResolverDebugInfo{
+		Datacenters: []consulresolver.DatacenterDebugInfo{
+			{Name: "", LastSuccess: &now},
+			{Name: "dc2"},
+			{Name: "dc3"},
+		},
+		RecentErrors: []consulresolver.DiscoveryError{{Time: now, Datacenter: "dc2", Error: "connection refused"}},
+	}
+	assert.Equal(t, []string{"dc3"}, pendingDatacenters(info))
+
+	info.Datacenters[2].LastSuccess = &now
+	assert.Empty(t, pendingDatacenters(info))
+}
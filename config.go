@@ -2,8 +2,10 @@ package consulresolver
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/hashicorp/consul/api"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type LogFn func(format string, args ...interface{})
@@ -25,17 +27,44 @@ type ServiceSpec struct {
 	// Optional
 	// Default: false (only healthy endpoints are used)
 	IncludeUnhealthy bool
+	// The TLS server name (SNI) to use when connecting to the service's instances.
+	// If set, this will override the hostname of the original request.
+	// Optional
+	// Default: ""
+	TLSServerName string
+	// A `Service.Meta` key holding the TLS server name of each instance.
+	// If set, and the key exists in the selected instance's metadata, its value takes precedence over `TLSServerName`.
+	// Optional
+	// Default: ""
+	TLSServerNameMetaKey string
 }
 
 type TransportConfig struct {
-	// A function that will be used for logging.
+	// A printf-style function that will be used for logging messages of LevelInfo and above, unless Logger is provided.
 	// Optional
 	// Default: log.Printf
 	Log LogFn
+	// A leveled, structured logger, taking precedence over Log.
+	// Optional
+	// Default: nil (Log is used)
+	Logger Logger
 	// The resolvers to be used for address resolution.
 	// Multiple resolvers are supported, and will be looked up by the `ServiceName`
-	// Mandatory
+	// Mandatory, unless HostResolvers is provided
 	Resolvers []Resolver
+	// Explicit mapping of hosts to resolvers, which takes precedence over any other matching.
+	// Optional
+	// Default: nil
+	HostResolvers map[string]Resolver
+	// Matchers used for mapping hosts to resolvers, when the host does not match any `ServiceName` exactly.
+	// The matchers are evaluated in order, and the first match which has a matching resolver is used.
+	// Optional
+	// Default: nil
+	HostMatchers []HostMatcher
+	// If set, resolvers will be created on demand for hosts matched by `HostMatchers` that have no registered resolver.
+	// Optional
+	// Default: nil
+	LazyResolvers *LazyResolverConfig
 	// If true, the transport will fallback to net/Resolver on resolver error
 	// Optional
 	// Default: false
@@ -44,13 +73,88 @@ type TransportConfig struct {
 	// Optional
 	// Default: http.DefaultTransport
 	Base http.RoundTripper
+	// Receives the outcome of every round trip of a request whose host has a resolver.
+	// Optional
+	// Default: nil (no metrics)
+	Metrics Metrics
+	// The provider of the tracer used for creating a span for every round trip of a request whose host has a resolver.
+	// Optional
+	// Default: nil (no tracing)
+	TracerProvider trace.TracerProvider
+}
+
+type DialerConfig struct {
+	// A printf-style function that will be used for logging messages of LevelInfo and above, unless Logger is provided.
+	// Optional
+	// Default: log.Printf
+	Log LogFn
+	// A leveled, structured logger, taking precedence over Log.
+	// Optional
+	// Default: nil (Log is used)
+	Logger Logger
+	// The resolvers to be used for address resolution.
+	// Multiple resolvers are supported, and will be looked up by the `ServiceName`
+	// Mandatory, unless HostResolvers is provided
+	Resolvers []Resolver
+	// Explicit mapping of hosts to resolvers, which takes precedence over any other matching.
+	// Optional
+	// Default: nil
+	HostResolvers map[string]Resolver
+	// Matchers used for mapping hosts to resolvers, when the host does not match any `ServiceName` exactly.
+	// The matchers are evaluated in order, and the first match which has a matching resolver is used.
+	// Optional
+	// Default: nil
+	HostMatchers []HostMatcher
+	// If set, resolvers will be created on demand for hosts matched by `HostMatchers` that have no registered resolver.
+	// Optional
+	// Default: nil
+	LazyResolvers *LazyResolverConfig
+	// If true, the dialer will fallback to dialing the original address on resolver error
+	// Optional
+	// Default: false
+	NetResolverFallback bool
+	// A base dial function to be used for establishing the underlying connections.
+	// Optional
+	// Default: net.Dialer.DialContext with a 30 seconds timeout and keep-alive
+	Dial DialFn
+}
+
+type LazyResolverConfig struct {
+	// The config used for creating resolvers on demand.
+	// The service name and datacenter are taken from the matched host, and the `Balancer` must be left empty.
+	// `WaitForReady` must not be set, as resolvers are created while handling requests, and neither must `SnapshotStore`,
+	// as a store cannot be shared between resolvers.
+	// Mandatory
+	Template ResolverConfig
+	// A function creating a Balancer for each created resolver.
+	// Optional
+	// Default: RoundRobinLoadBalancer
+	NewBalancer func(HostMatch) Balancer
+	// The duration after which an unused resolver is stopped and evicted.
+	// Optional
+	// Default: 10 minutes
+	IdleTTL time.Duration
+	// The duration for which a failure to create a resolver is remembered, during which lookups of its hosts fail
+	// immediately instead of retrying the creation.
+	// Optional
+	// Default: 5 seconds
+	FailureBackoff time.Duration
+	// The maximal duration of creating a resolver, which may query the local Consul agent, after which the creation fails.
+	// Lookups waiting for a creation are also bounded by the context of their request.
+	// Optional
+	// Default: 10 seconds
+	CreateTimeout time.Duration
 }
 
 type ResolverConfig struct {
-	// A function that will be used for logging.
+	// A printf-style function that will be used for logging messages of LevelInfo and above, unless Logger is provided.
 	// Optional
 	// Default: log.Printf
 	Log LogFn
+	// A leveled, structured logger, taking precedence over Log.
+	// Optional
+	// Default: nil (Log is used)
+	Logger Logger
 	// The Service Spec the resolver will handle
 	// Mandatory
 	ServiceSpec ServiceSpec
@@ -59,12 +163,116 @@ type ResolverConfig struct {
 	// Default: RoundRobinLoadBalancer
 	Balancer Balancer
 	// The consul client
-	// Mandatory
+	// Mandatory, unless Discovery is provided
 	Client *api.Client
+	// The discovery backend providing the service's instances.
+	// When provided, the Consul specific options (Query, AllowStale, MaxLastContact, UseCache, CacheMaxAge,
+	// CacheStaleIfError and PreferStreaming) are ignored, and Client is only used for determining the local datacenter.
+	// Optional
+	// Default: a ConsulDiscovery using Client
+	Discovery Discovery
 	// The consul query options configuration
 	// Optional
 	Query *api.QueryOptions
+	// The datacenter to query with the highest priority.
+	// Optional. Will use the local DC if not provided.
+	Datacenter string
 	// A list of datacenters to query, ordered by priority.
 	// Optional. Will use only the local DC if not provided.
 	FallbackDatacenters []string
+	// If true, queries may be served by any Consul server, rather than only by the leader.
+	// This greatly reduces the load on the leader, at the cost of possibly stale results.
+	// Optional
+	// Default: false
+	AllowStale bool
+	// If set, responses whose `QueryMeta.LastContact` exceeds this duration are rejected, and the query is retried.
+	// Only relevant when stale reads are allowed.
+	// Optional
+	// Default: 0 (no limit)
+	MaxLastContact time.Duration
+	// If true, queries are served from the local agent's cache, reducing the load on the Consul servers.
+	// Optional
+	// Default: false
+	UseCache bool
+	// The maximal age of a cached response. Only relevant when `UseCache` is true.
+	// Optional
+	// Default: 0 (the agent's default)
+	CacheMaxAge time.Duration
+	// How stale a cached response may be, if refreshing it failed. Only relevant when `UseCache` is true.
+	// Optional
+	// Default: 0 (the agent's default)
+	CacheStaleIfError time.Duration
+	// If true, and the local agent has the streaming backend enabled (Consul 1.10+), the resolver will let the agent serve
+	// its queries using streaming, which dramatically reduces the load on the Consul servers.
+	// Since the agent does not stream queries served from its cache, `UseCache` is ignored (and a message is logged) in that case.
+	// If the agent does not support streaming, or its support could not be determined, the resolver falls back to regular
+	// blocking queries.
+	// Optional
+	// Default: false
+	PreferStreaming bool
+	// A pool used for sharing Consul watches between resolvers querying the same service, tags, health, datacenter and query options (e.g. filter and node meta).
+	// Watches are only shared by resolvers with the same Metrics, which receive the measurements of the shared queries.
+	// Optional
+	// Default: nil (the resolver runs its own watches)
+	WatcherPool *WatcherPool
+	// The maximal duration, measured from the resolver's creation, to wait for its first successful response from Consul.
+	// Once elapsed, Resolve will immediately return ErrNotInitialized until the resolver is ready.
+	// Optional
+	// Default: 0 (wait until the context passed to Resolve is done)
+	InitTimeout time.Duration
+	// If true, NewConsulResolver will block until the resolver is ready, bounded by its context and the InitTimeout,
+	// and will return an error if the resolver failed to become ready.
+	// Optional
+	// Default: false
+	WaitForReady bool
+	// A store used for persisting the resolver's targets whenever they change.
+	// On startup, the resolver is seeded from the stored snapshot (and marked as stale) until Consul responds.
+	// Snapshots saved by resolvers with a different service spec or datacenters are ignored.
+	// The store must not be shared between resolvers, as each resolver overwrites the snapshot.
+	// Optional
+	// Default: nil
+	SnapshotStore SnapshotStore
+	// The maximal age of a snapshot that may be used for seeding the resolver, measured since its targets were last
+	// confirmed by Consul.
+	// Optional
+	// Default: 0 (no limit)
+	SnapshotMaxAge time.Duration
+	// Receives the measurements of the resolver, such as query results, target counts and resolutions.
+	// Optional
+	// Default: nil (no metrics)
+	Metrics Metrics
+	// The provider of the tracer used for creating a span for every resolution.
+	// Optional
+	// Default: nil (no tracing)
+	TracerProvider trace.TracerProvider
+}
+
+type ChainResolverConfig struct {
+	// The name of the service the chain resolves
+	// Optional
+	// Default: the service name of the first source
+	ServiceName string
+	// The sources to resolve the service from, ordered by priority
+	// Mandatory
+	Sources []ChainSource
+	// If true, the targets of all the sources that resolved successfully are merged into one target set,
+	// which is balanced using round robin. Otherwise, the first source that resolves successfully is used.
+	// Sources that do not implement MultiResolver contribute a single target per resolution.
+	// Optional
+	// Default: false
+	Merge bool
+}
+
+type ChainSource struct {
+	// The name of the source, reported as the source that answered
+	// Optional
+	// Default: the source's position in the chain
+	Name string
+	// The resolver of the source
+	// Mandatory
+	Resolver Resolver
+	// The maximal duration to wait for the source to resolve, before moving on to the next source
+	// Optional
+	// Default: 0 (bounded only by the caller's context)
+	Timeout time.Duration
 }
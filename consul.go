@@ -3,8 +3,6 @@ package consulresolver
 import (
 	"context"
 	"fmt"
-	"log"
-	"math"
 	"reflect"
 	"sort"
 	"sync"
@@ -13,20 +11,38 @@ import (
 	"github.com/mitchellh/mapstructure"
 
 	"github.com/AppsFlyer/go-consul-resolver/lb"
-	"github.com/cenkalti/backoff/v4"
 	"github.com/friendsofgo/errors"
 	"github.com/hashicorp/consul/api"
-	"go.uber.org/ratelimit"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// ErrNotInitialized is returned by Resolve when the resolver did not receive a successful response from Consul within the configured InitTimeout
+var ErrNotInitialized = errors.New("resolver not initialized")
+
 type agentConfig struct {
 	DC string `mapstructure:"Datacenter"`
 }
 
+type agentDebugConfig struct {
+	UseStreamingBackend bool `mapstructure:"UseStreamingBackend"`
+}
+
 type agentSelf struct {
-	Config agentConfig `mapstructure:"Config"`
+	Config      agentConfig      `mapstructure:"Config"`
+	DebugConfig agentDebugConfig `mapstructure:"DebugConfig"`
 }
 
+// QueryBackend describes how the resolver watches Consul for changes
+type QueryBackend string
+
+const (
+	// QueryBackendBlocking denotes blocking queries served by the Consul servers (or the agent's cache)
+	QueryBackendBlocking QueryBackend = "blocking"
+	// QueryBackendStreaming denotes blocking queries which the local agent serves using the streaming backend
+	QueryBackendStreaming QueryBackend = "streaming"
+)
+
 // Balancer interface provides methods for selecting a target and updating its state
 type Balancer interface {
 	// Select returns a *api.ServiceEntry describing the selected target.
@@ -43,25 +59,48 @@ type ServiceProvider interface {
 }
 
 type ServiceResolver struct {
-	log                  LogFn
+	logger               Logger
 	ctx                  context.Context
-	client               ServiceProvider
-	queryOpts            *api.QueryOptions
+	cancel               context.CancelFunc
+	watchers             sync.WaitGroup
+	unsubscribes         []func()
+	discovery            Discovery
+	metrics              Metrics
+	tracer               trace.Tracer
 	balancer             Balancer
+	balancerName         string // the type of the balancer, reported in traces
 	spec                 ServiceSpec
+	datacenter           string
+	initDeadline         time.Time
+	datacenters          []string
 	prioritizedInstances [][]*api.ServiceEntry
+	stale                []bool // datacenters seeded from a snapshot, and not yet updated from Consul
+	queryMeta            []*api.QueryMeta
+	lastSuccess          []time.Time // the time of the last successful response of every datacenter
+	backend              QueryBackend
+	version              uint64 // incremented whenever prioritizedInstances changes
+	snapshots            SnapshotStore
+	savedVersion         uint64
+	snapshotCreatedAt    time.Time
+	snapshotConfirmedAt  time.Time
+	snapshotMu           sync.Mutex
 	mu                   sync.Mutex
 	init                 chan struct{}
 	initDone             sync.Once
+	targetsMu            sync.Mutex // serializes balancer updates and subscriber notifications
+	activeTargets        []*api.ServiceEntry
+	activePriority       int
+	subscriptions        []*subscription
+	recentErrors         []DiscoveryError // the last discovery errors, oldest first
 }
 
 // NewConsulResolver creates a new Consul Resolver
 // ctx - a context used for graceful termination of the consul-watcher go routine.
-// Note that canceling the context will render the resolver stale, and any attempt to use it will immediately return an error
+// Note that canceling the context (or calling Close) will render the resolver stale, and any attempt to use it will immediately return an error
 // conf - the resolver's config
 func NewConsulResolver(ctx context.Context, conf ResolverConfig) (*ServiceResolver, error) {
 
-	if conf.Client == nil {
+	if conf.Client == nil && conf.Discovery == nil {
 		return nil, errors.New("consul client must not be nil")
 	}
 
@@ -69,53 +108,113 @@ func NewConsulResolver(ctx context.Context, conf ResolverConfig) (*ServiceResolv
 		return nil, errors.New("service name must not be empty")
 	}
 
-	if conf.Query == nil {
-		conf.Query = &api.QueryOptions{}
-	} else {
-		conf.Query.WaitIndex = 0
+	// Copy the query options, as they are modified below and may be shared with other resolvers
+	var query api.QueryOptions
+	if conf.Query != nil {
+		query = *conf.Query
+	}
+	query.WaitIndex = 0
+	logger := withComponent(newLogger(conf.Logger, conf.Log), componentResolver)
+	backend := QueryBackendBlocking
+	if conf.PreferStreaming && conf.Discovery == nil {
+		streaming, err := isStreamingEnabled(ctx, conf.Client)
+		switch {
+		case err != nil:
+			logger.Log(LevelWarn, "failed determining consul streaming support, using blocking queries",
+				serviceField(conf.ServiceSpec.ServiceName), errorField(err))
+		case streaming:
+			backend = QueryBackendStreaming
+			// The agent only uses the streaming backend for blocking queries that are not served from its cache
+			if conf.UseCache {
+				logger.Log(LevelInfo, "the agent supports streaming, ignoring UseCache",
+					serviceField(conf.ServiceSpec.ServiceName))
+				conf.UseCache = false
+			}
+		}
+	}
+	applyConsistencyMode(&query, conf)
+
+	if conf.Discovery == nil {
+		conf.Discovery = newConsulDiscovery(conf.Client.Health(), conf.Client, query, conf.MaxLastContact)
 	}
 
 	if conf.Balancer == nil {
 		conf.Balancer = &lb.RoundRobinLoadBalancer{}
 	}
 
-	if conf.Log == nil {
-		conf.Log = log.Printf
+	if conf.Metrics == nil {
+		conf.Metrics = noopMetrics{}
 	}
 
-	datacenters := []string{""}
-	if len(conf.FallbackDatacenters) > 0 {
-		seen := map[string]struct{}{}
-		// Exclude the local datacenter from the list of fallback datacenters
-		localDC, err := getLocalDatacenter(conf.Client.Agent())
-		if err != nil {
-			return nil, errors.Wrap(err, "failed determining local consul datacenter")
-		}
-
-		for _, dc := range conf.FallbackDatacenters {
-			if _, ok := seen[dc]; ok || dc == localDC {
-				continue
-			}
-			seen[dc] = struct{}{}
-			datacenters = append(datacenters, dc)
-		}
+	datacenters, err := getDatacenters(ctx, conf)
+	if err != nil {
+		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	var initDeadline time.Time
+	if conf.InitTimeout > 0 {
+		initDeadline = time.Now().Add(conf.InitTimeout)
+	}
 	resolver := &ServiceResolver{
-		log:                  conf.Log,
+		logger:               logger,
 		ctx:                  ctx,
-		queryOpts:            conf.Query,
+		cancel:               cancel,
+		initDeadline:         initDeadline,
 		spec:                 conf.ServiceSpec,
-		client:               conf.Client.Health(),
+		datacenter:           conf.Datacenter,
+		discovery:            conf.Discovery,
+		metrics:              conf.Metrics,
+		tracer:               newTracer(conf.TracerProvider),
 		balancer:             conf.Balancer,
+		balancerName:         fmt.Sprintf("%T", conf.Balancer),
+		datacenters:          datacenters,
 		prioritizedInstances: make([][]*api.ServiceEntry, len(datacenters)),
+		stale:                make([]bool, len(datacenters)),
+		queryMeta:            make([]*api.QueryMeta, len(datacenters)),
+		lastSuccess:          make([]time.Time, len(datacenters)),
+		backend:              backend,
+		snapshots:            conf.SnapshotStore,
 		init:                 make(chan struct{}),
 		initDone:             sync.Once{},
+		activePriority:       -1,
 	}
 
-	// Always prepend the local datacenter with the highest priority
-	for priority, dc := range datacenters {
-		go resolver.populateFromConsul(dc, priority)
+	if conf.SnapshotStore != nil {
+		resolver.seedFromSnapshot(conf.SnapshotMaxAge)
+	}
+
+	// Always prepend the primary datacenter with the highest priority
+	if conf.WatcherPool != nil {
+		for priority, dc := range datacenters {
+			w := newWatcher(conf.Discovery, conf.ServiceSpec, dc, resolver.logger, conf.Metrics)
+			unsubscribe := conf.WatcherPool.subscribe(w, dcSubscriber{resolver: resolver, priority: priority})
+			resolver.unsubscribes = append(resolver.unsubscribes, unsubscribe)
+		}
+		// pooled watchers outlive the resolver's context, so unsubscribe once it is done
+		resolver.watchers.Add(1)
+		go func() {
+			defer resolver.watchers.Done()
+			<-ctx.Done()
+			for _, unsubscribe := range resolver.unsubscribes {
+				unsubscribe()
+			}
+		}()
+	} else {
+		resolver.watchers.Add(len(datacenters))
+		for priority, dc := range datacenters {
+			go func(dc string, priority int) {
+				defer resolver.watchers.Done()
+				resolver.watch(dc, priority)
+			}(dc, priority)
+		}
+	}
+
+	if conf.WaitForReady {
+		if err := resolver.waitReadyWithTimeout(ctx); err != nil {
+			_ = resolver.Close()
+			return nil, errors.Wrap(err, fmt.Sprintf("resolver for service %s failed to become ready", conf.ServiceSpec.ServiceName))
+		}
 	}
 
 	return resolver, nil
@@ -126,23 +225,214 @@ func (r *ServiceResolver) ServiceName() string {
 	return r.spec.ServiceName
 }
 
-// Resolve returns a single ServiceAddress instance of the resolved target
-func (r *ServiceResolver) Resolve(ctx context.Context) (ServiceAddress, error) {
+// Datacenter returns the primary datacenter the resolver is querying, or an empty string if it is the local datacenter
+func (r *ServiceResolver) Datacenter() string {
+	return r.datacenter
+}
 
-	// make sure balancer initialized
+// Close stops the resolver, canceling any in-flight Consul query, and waits for all the consul-watcher go routines to exit.
+// Any attempt to use the resolver after it was closed will immediately return an error.
+func (r *ServiceResolver) Close() error {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.watchers.Wait()
+	return nil
+}
+
+// Ready returns a channel that is closed once the resolver received its first successful response from Consul
+func (r *ServiceResolver) Ready() <-chan struct{} {
+	return r.init
+}
+
+// WaitReady blocks until the resolver is ready, the given context is done or the resolver is closed
+func (r *ServiceResolver) WaitReady(ctx context.Context) error {
 	select {
+	case <-r.init:
+		return nil
 	case <-ctx.Done():
-		return ServiceAddress{}, ctx.Err()
+		return ctx.Err()
 	case <-r.ctx.Done():
-		return ServiceAddress{}, r.ctx.Err()
+		return r.ctx.Err()
+	}
+}
+
+// waitReadyWithTimeout waits for the resolver to become ready,
+// returning ErrNotInitialized if the InitTimeout elapsed since the resolver was created
+func (r *ServiceResolver) waitReadyWithTimeout(ctx context.Context) error {
+	select {
+	case <-r.init:
+		return nil
+	default:
+	}
+
+	if r.initDeadline.IsZero() {
+		return r.WaitReady(ctx)
+	}
+
+	remaining := time.Until(r.initDeadline)
+	if remaining <= 0 {
+		return ErrNotInitialized
+	}
+
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
 	case <-r.init:
-		break
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	case <-timer.C:
+		return ErrNotInitialized
+	}
+}
+
+// Backend returns the backend used for watching Consul
+func (r *ServiceResolver) Backend() QueryBackend {
+	return r.backend
+}
+
+// DatacenterStatus describes the state of the resolver's watch on a single datacenter
+type DatacenterStatus struct {
+	// The name of the datacenter, or an empty string for the local datacenter
+	Name string
+	// The number of instances last received for the datacenter
+	Instances int
+	// True if the instances were seeded from a snapshot, and not yet updated from Consul
+	Stale bool
+	// The meta of the last Consul response, or nil if no response was received yet.
+	// LastContact and CacheHit may be used for determining how stale the data is.
+	QueryMeta *api.QueryMeta
+	// The time of the last successful response from the discovery backend, or the zero time if none was received yet
+	LastSuccess time.Time
+}
+
+// Status returns the state of every datacenter watched by the resolver, ordered by priority
+func (r *ServiceResolver) Status() []DatacenterStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := make([]DatacenterStatus, 0, len(r.datacenters))
+	for priority, name := range r.datacenters {
+		res = append(res, DatacenterStatus{
+			Name:      name,
+			Instances: len(r.prioritizedInstances[priority]),
+			Stale:     r.stale[priority],
+			QueryMeta: r.queryMeta[priority],
+		})
+		if priority < len(r.lastSuccess) {
+			res[priority].LastSuccess = r.lastSuccess[priority]
+		}
+	}
+	return res
+}
+
+func (r *ServiceResolver) recordQueryMeta(priority int, meta *api.QueryMeta) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if priority < len(r.queryMeta) {
+		r.queryMeta[priority] = meta
+	}
+}
+
+// recordSuccess records the meta and the time of a successful response of the datacenter
+func (r *ServiceResolver) recordSuccess(priority int, meta *api.QueryMeta) {
+	r.recordQueryMeta(priority, meta)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if priority < len(r.lastSuccess) {
+		r.lastSuccess[priority] = time.Now()
+	}
+}
+
+// Stale returns true while the targets of any datacenter are seeded from a snapshot, and were not yet updated from Consul
+func (r *ServiceResolver) Stale() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, stale := range r.stale {
+		if stale {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns a single ServiceAddress instance of the resolved target
+func (r *ServiceResolver) Resolve(ctx context.Context) (ServiceAddress, error) {
+	ctx, span := r.tracer.Start(ctx, "consul_resolver.Resolve", trace.WithAttributes(
+		AttrServiceName.String(r.spec.ServiceName),
+		AttrBalancer.String(r.balancerName),
+	))
+	defer span.End()
+
+	start := time.Now()
+	t, err := r.resolve(ctx)
+	if err != nil {
+		r.metrics.Resolve(r.spec.ServiceName, "", time.Since(start), err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return ServiceAddress{}, err
+	}
+
+	r.metrics.Resolve(r.spec.ServiceName, t.Service.ID, time.Since(start), nil)
+	if span.IsRecording() {
+		span.SetAttributes(AttrInstanceID.String(t.Service.ID))
+		if t.Node != nil {
+			span.SetAttributes(AttrNode.String(t.Node.Node), AttrDatacenter.String(t.Node.Datacenter))
+		}
+	}
+	return r.addressOf(t), nil
+}
+
+// resolve selects a target using the balancer, once the resolver is ready
+func (r *ServiceResolver) resolve(ctx context.Context) (*api.ServiceEntry, error) {
+	// a stale resolver must fail even if it was initialized
+	if err := r.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// make sure balancer initialized
+	if err := r.waitReadyWithTimeout(ctx); err != nil {
+		return nil, err
 	}
 
 	t, err := r.balancer.Select()
 	if err != nil {
-		return ServiceAddress{}, errors.Wrap(err, fmt.Sprintf("failed to resolve address for service %s", r.spec.ServiceName))
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to resolve address for service %s", r.spec.ServiceName))
+	}
+	return t, nil
+}
+
+// ResolveAll returns the addresses of all the targets in the active target set, respecting datacenter failover
+func (r *ServiceResolver) ResolveAll(ctx context.Context) ([]ServiceAddress, error) {
+
+	if err := r.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := r.waitReadyWithTimeout(ctx); err != nil {
+		return nil, err
 	}
+
+	r.targetsMu.Lock()
+	targets := r.activeTargets
+	r.targetsMu.Unlock()
+
+	if len(targets) == 0 {
+		return nil, errors.Errorf("failed to resolve addresses for service %s - no targets available", r.spec.ServiceName)
+	}
+
+	res := make([]ServiceAddress, 0, len(targets))
+	for _, t := range targets {
+		res = append(res, r.addressOf(t))
+	}
+	return res, nil
+}
+
+// addressOf returns the address of the given target
+func (r *ServiceResolver) addressOf(t *api.ServiceEntry) ServiceAddress {
 	var host string
 	var port int
 
@@ -160,57 +450,72 @@ func (r *ServiceResolver) Resolve(ctx context.Context) (ServiceAddress, error) {
 		port = t.Service.Port
 	}
 
-	return ServiceAddress{Host: host, Port: port}, nil
-}
-
-func (r *ServiceResolver) populateFromConsul(dcName string, dcPriority int) {
-	rl := ratelimit.New(1) // limit consul queries to 1 per second
-	bck := backoff.NewExponentialBackOff()
-	bck.MaxElapsedTime = 0
-	bck.MaxInterval = time.Second * 30
-
-	q := *r.queryOpts
-
-	q.WaitIndex = 0
-	q.Datacenter = dcName
-	for r.ctx.Err() == nil {
-		rl.Take()
-		err := backoff.RetryNotify(
-			func() error {
-				se, meta, err := r.client.ServiceMultipleTags(
-					r.spec.ServiceName,
-					r.spec.Tags,
-					!r.spec.IncludeUnhealthy,
-					&q,
-				)
-				if err != nil {
-					return err
-				}
-				if meta.LastIndex < q.WaitIndex {
-					q.WaitIndex = 0
-				} else {
-					q.WaitIndex = uint64(math.Max(float64(1), float64(meta.LastIndex)))
-				}
-
-				if targets, shouldUpdate := r.getTargetsForUpdate(se, dcPriority); shouldUpdate {
-					r.balancer.UpdateTargets(targets)
-				}
-
-				r.initDone.Do(func() {
-					close(r.init)
-				})
-				return nil
-			},
-			bck,
-			func(err error, duration time.Duration) {
-				r.log("[Consul Resolver] failure querying consul, sleeping %s - %s", duration, err.Error())
-			},
-		)
-		if err != nil {
-			r.log("[Consul Resolver] failure querying consul - %s", err.Error())
+	return ServiceAddress{Host: host, Port: port, ServerName: r.serverName(t)}
+}
+
+// serverName returns the TLS server name to use for the given target, or an empty string if none is configured
+func (r *ServiceResolver) serverName(t *api.ServiceEntry) string {
+	if r.spec.TLSServerNameMetaKey != "" {
+		if name, ok := t.Service.Meta[r.spec.TLSServerNameMetaKey]; ok && name != "" {
+			return name
 		}
 	}
-	r.log("[Consul Resolver] context canceled, stopping consul watcher")
+	return r.spec.TLSServerName
+}
+
+// watch watches the instances of the given datacenter until the resolver is closed
+func (r *ServiceResolver) watch(dcName string, dcPriority int) {
+	w := newWatcher(r.discovery, r.spec, dcName, r.logger, r.metrics)
+	w.subscribe(dcSubscriber{resolver: r, priority: dcPriority})
+	w.run(r.ctx)
+}
+
+// dcSubscriber receives the results of the watcher of a single datacenter
+type dcSubscriber struct {
+	resolver *ServiceResolver
+	priority int
+}
+
+func (s dcSubscriber) onUpdate(se []*api.ServiceEntry, meta *api.QueryMeta) {
+	s.resolver.update(s.priority, se, meta)
+}
+
+func (s dcSubscriber) onError(err error) {
+	// rejected responses are still reported in the status, so that their LastContact is visible
+	var stale *StaleResponseError
+	if errors.As(err, &stale) {
+		s.resolver.recordQueryMeta(s.priority, stale.QueryMeta)
+	}
+	s.resolver.recordError(s.priority, err)
+}
+
+// update handles the instances received for the datacenter, and updates the balancer if needed
+func (r *ServiceResolver) update(dcPriority int, se []*api.ServiceEntry, meta *api.QueryMeta) {
+	r.recordSuccess(dcPriority, meta)
+	r.metrics.Targets(r.spec.ServiceName, r.datacenterName(dcPriority), len(se))
+
+	if targets, shouldUpdate := r.getTargetsForUpdate(se, dcPriority); shouldUpdate {
+		r.setTargets(targets, r.activeDatacenterPriority())
+	}
+	if r.snapshots != nil {
+		r.saveSnapshot()
+	}
+
+	r.initDone.Do(func() {
+		close(r.init)
+	})
+}
+
+// activeDatacenterPriority returns the priority of the highest priority datacenter that has instances, or -1 if there is none
+func (r *ServiceResolver) activeDatacenterPriority() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, instances := range r.prioritizedInstances {
+		if len(instances) > 0 {
+			return i
+		}
+	}
+	return -1
 }
 
 // getTargetsForUpdate will update the LB only if:
@@ -225,11 +530,15 @@ func (r *ServiceResolver) getTargetsForUpdate(se []*api.ServiceEntry, priority i
 	defer r.mu.Unlock()
 
 	var found bool
+	if priority < len(r.stale) {
+		r.stale[priority] = false
+	}
 	// check if the target list is unchanged
 	if reflect.DeepEqual(se, r.prioritizedInstances[priority]) {
 		return nil, false
 	}
 	r.prioritizedInstances[priority] = se
+	r.version++
 	for i := 0; i <= len(r.prioritizedInstances)-1; i++ {
 		if len(r.prioritizedInstances[i]) == 0 {
 			continue
@@ -250,16 +559,187 @@ func (r *ServiceResolver) getTargetsForUpdate(se []*api.ServiceEntry, priority i
 	return se, false
 }
 
-func getLocalDatacenter(c *api.Agent) (string, error) {
-	res, err := c.Self()
+// seedFromSnapshot loads the snapshot of the resolver's targets, and uses it to initialize the balancer.
+// Snapshots of other services, or older than maxAge (if positive), are ignored.
+func (r *ServiceResolver) seedFromSnapshot(maxAge time.Duration) {
+	snapshot, err := r.snapshots.Load()
 	if err != nil {
-		return "", errors.Wrap(err, "failed querying agent")
+		r.logger.Log(LevelWarn, "failed loading snapshot", serviceField(r.spec.ServiceName), errorField(err))
+		return
+	}
+	if snapshot == nil || snapshot.ServiceName != r.spec.ServiceName {
+		return
+	}
+	if !reflect.DeepEqual(snapshot.Spec, r.snapshotSpec()) {
+		r.logger.Log(LevelInfo, "ignoring snapshot of a different spec", serviceField(r.spec.ServiceName))
+		return
+	}
+	confirmedAt := snapshot.ConfirmedAt
+	if confirmedAt.IsZero() {
+		confirmedAt = snapshot.CreatedAt
+	}
+	if maxAge > 0 && time.Since(confirmedAt) > maxAge {
+		r.logger.Log(LevelInfo, "ignoring expired snapshot", serviceField(r.spec.ServiceName), Field{Key: "confirmed_at", Value: confirmedAt})
+		return
 	}
 
-	var self agentSelf
-	if err := mapstructure.Decode(res, &self); err != nil {
-		return "", errors.Wrap(err, "failed decoding agent configuration")
+	r.mu.Lock()
+	r.snapshotCreatedAt = snapshot.CreatedAt
+	var targets []*api.ServiceEntry
+	for _, dc := range snapshot.Datacenters {
+		for priority, name := range r.datacenters {
+			if dc.Name == name && len(dc.Instances) > 0 {
+				r.prioritizedInstances[priority] = dc.Instances
+				r.stale[priority] = true
+			}
+		}
+	}
+	for _, instances := range r.prioritizedInstances {
+		if len(instances) > 0 {
+			targets = instances
+			break
+		}
+	}
+	r.mu.Unlock()
+
+	if len(targets) == 0 {
+		return
+	}
+
+	r.logger.Log(LevelInfo, "seeding from snapshot", serviceField(r.spec.ServiceName), Field{Key: "confirmed_at", Value: confirmedAt})
+	r.setTargets(targets, r.activeDatacenterPriority())
+	r.initDone.Do(func() {
+		close(r.init)
+	})
+}
+
+// saveSnapshot persists the resolver's targets, if they changed since the last save.
+// Unchanged targets are saved at most once per snapshotConfirmInterval, for refreshing the snapshot's ConfirmedAt.
+func (r *ServiceResolver) saveSnapshot() {
+	// serialize saves, so that an older snapshot never overwrites a newer one
+	r.snapshotMu.Lock()
+	defer r.snapshotMu.Unlock()
+
+	now := time.Now()
+	r.mu.Lock()
+	changed := r.version != r.savedVersion
+	if !changed && now.Sub(r.snapshotConfirmedAt) < snapshotConfirmInterval {
+		r.mu.Unlock()
+		return
+	}
+	if changed || r.snapshotCreatedAt.IsZero() {
+		r.snapshotCreatedAt = now
+	}
+	snapshot := &Snapshot{
+		Version:     SnapshotVersion,
+		ServiceName: r.spec.ServiceName,
+		Spec:        r.snapshotSpec(),
+		CreatedAt:   r.snapshotCreatedAt,
+		ConfirmedAt: now,
+		Datacenters: make([]SnapshotDatacenter, 0, len(r.datacenters)),
+	}
+	for priority, name := range r.datacenters {
+		snapshot.Datacenters = append(snapshot.Datacenters, SnapshotDatacenter{Name: name, Instances: r.prioritizedInstances[priority]})
+	}
+	version := r.version
+	r.mu.Unlock()
+
+	if err := r.snapshots.Save(snapshot); err != nil {
+		r.logger.Log(LevelWarn, "failed saving snapshot", serviceField(r.spec.ServiceName), errorField(err))
+		return
+	}
+
+	r.mu.Lock()
+	r.savedVersion = version
+	r.snapshotConfirmedAt = now
+	r.mu.Unlock()
+}
+
+// snapshotSpec returns the spec identifying the resolver's snapshots
+func (r *ServiceResolver) snapshotSpec() *SnapshotSpec {
+	tags := append([]string(nil), r.spec.Tags...)
+	sort.Strings(tags)
+	return &SnapshotSpec{
+		Tags:             tags,
+		IncludeUnhealthy: r.spec.IncludeUnhealthy,
+		ServicePort:      r.spec.ServicePort,
+		Datacenters:      append([]string(nil), r.datacenters...),
+	}
+}
+
+// applyConsistencyMode sets the stale read and agent caching options of the config on the query
+func applyConsistencyMode(q *api.QueryOptions, conf ResolverConfig) {
+	if conf.AllowStale {
+		q.AllowStale = true
+		q.RequireConsistent = false
+	}
+	if conf.UseCache {
+		q.UseCache = true
+		q.MaxAge = conf.CacheMaxAge
+		q.StaleIfError = conf.CacheStaleIfError
+	}
+}
+
+// getDatacenters returns the datacenters to query, ordered by priority
+func getDatacenters(ctx context.Context, conf ResolverConfig) ([]string, error) {
+	datacenters := []string{conf.Datacenter}
+	if len(conf.FallbackDatacenters) == 0 {
+		return datacenters, nil
 	}
 
+	seen := map[string]struct{}{}
+	// Exclude the primary datacenter from the list of fallback datacenters
+	primaryDC := conf.Datacenter
+	if primaryDC == "" && conf.Client != nil {
+		localDC, err := getLocalDatacenter(ctx, conf.Client)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed determining local consul datacenter")
+		}
+		primaryDC = localDC
+	}
+
+	for _, dc := range conf.FallbackDatacenters {
+		if _, ok := seen[dc]; ok || dc == primaryDC {
+			continue
+		}
+		seen[dc] = struct{}{}
+		datacenters = append(datacenters, dc)
+	}
+	return datacenters, nil
+}
+
+func getLocalDatacenter(ctx context.Context, c *api.Client) (string, error) {
+	self, err := getAgentSelf(ctx, c)
+	if err != nil {
+		return "", err
+	}
 	return self.Config.DC, nil
 }
+
+// isStreamingEnabled returns true if the local agent is configured to use the streaming backend
+func isStreamingEnabled(ctx context.Context, c *api.Client) (bool, error) {
+	self, err := getAgentSelf(ctx, c)
+	if err != nil {
+		return false, err
+	}
+	return self.DebugConfig.UseStreamingBackend, nil
+}
+
+// getAgentSelf queries the configuration of the local agent, until the context is done
+func getAgentSelf(ctx context.Context, c *api.Client) (*agentSelf, error) {
+	// Agent().Self does not accept a context, so the endpoint is queried directly.
+	// Raw queries do not check the response code, so a response without the agent's config is an error response.
+	var res map[string]map[string]interface{}
+	if _, err := c.Raw().Query("/v1/agent/self", &res, (&api.QueryOptions{}).WithContext(ctx)); err != nil {
+		return nil, errors.Wrap(err, "failed querying agent")
+	}
+	if _, ok := res["Config"]; !ok {
+		return nil, errors.New("failed querying agent: unexpected response")
+	}
+
+	var self agentSelf
+	if err := mapstructure.Decode(res, &self); err != nil {
+		return nil, errors.Wrap(err, "failed decoding agent configuration")
+	}
+	return &self, nil
+}
@@ -2,7 +2,12 @@ package consulresolver
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -10,6 +15,7 @@ import (
 	"github.com/AppsFlyer/go-consul-resolver/lb"
 	"github.com/hashicorp/consul/api"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type MockClient struct {
@@ -54,19 +60,20 @@ func TestConsulResolver(t *testing.T) {
 
 	c := &MockClient{endpoints}
 	r := &ServiceResolver{
-		client:               c,
+		discovery:            newConsulDiscovery(c, nil, api.QueryOptions{}, 0),
 		ctx:                  context.Background(),
 		balancer:             &lb.RoundRobinLoadBalancer{},
 		spec:                 ServiceSpec{ServiceName: "service"},
-		queryOpts:            &api.QueryOptions{},
 		prioritizedInstances: make([][]*api.ServiceEntry, 1),
-		log:                  log.Printf,
+		logger:               newLogger(nil, nil),
+		metrics:              noopMetrics{},
+		tracer:               newTracer(nil),
 		init:                 make(chan struct{}),
 		initDone:             sync.Once{},
 	}
-	go r.populateFromConsul("dc", 0)
+	go r.watch("dc", 0)
 
-	expected := []ServiceAddress{{"localhost", 8080}, {"localhost2", 8081}}
+	expected := []ServiceAddress{{Host: "localhost", Port: 8080}, {Host: "localhost2", Port: 8081}}
 
 	for i := 0; i < 100; i++ {
 		go func() {
@@ -186,3 +193,302 @@ func TestServiceResolver_getTargetsForUpdate(t *testing.T) {
 		})
 	}
 }
+
+func TestServiceResolver_serverName(t *testing.T) {
+	entry := &api.ServiceEntry{Service: &api.AgentService{Meta: map[string]string{"tls-name": "meta.example.com"}}}
+
+	tests := []struct {
+		name string
+		spec ServiceSpec
+		want string
+	}{
+		{name: "nothing configured - should return empty string", spec: ServiceSpec{}, want: ""},
+		{name: "override configured - should return override", spec: ServiceSpec{TLSServerName: "example.com"}, want: "example.com"},
+		{
+			name: "meta key configured - should return meta value",
+			spec: ServiceSpec{TLSServerName: "example.com", TLSServerNameMetaKey: "tls-name"},
+			want: "meta.example.com",
+		},
+		{
+			name: "meta key missing - should return override",
+			spec: ServiceSpec{TLSServerName: "example.com", TLSServerNameMetaKey: "other"},
+			want: "example.com",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := &ServiceResolver{spec: tt.spec}
+			assert.Equal(t, tt.want, r.serverName(entry))
+		})
+	}
+}
+
+func TestServiceResolverClose(t *testing.T) {
+	client, fake := newFakeConsulClient(t)
+
+	r, err := NewConsulResolver(context.Background(), ResolverConfig{
+		ServiceSpec: ServiceSpec{ServiceName: "service"},
+		Client:      client,
+	})
+	assert.NoError(t, err)
+
+	_, err = r.Resolve(context.Background())
+	assert.NoError(t, err)
+
+	// Close waits for the watcher to exit, so no query is issued once it returns
+	assert.NoError(t, r.Close())
+	queries := fake.issuedFor("service@")
+	assert.Greater(t, queries, 0)
+
+	_, err = r.Resolve(context.Background())
+	assert.ErrorIs(t, err, context.Canceled)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, queries, fake.issuedFor("service@"))
+}
+
+func TestServiceResolverReady(t *testing.T) {
+	client, _ := newFakeConsulClient(t)
+
+	r, err := NewConsulResolver(context.Background(), ResolverConfig{
+		ServiceSpec:  ServiceSpec{ServiceName: "service"},
+		Client:       client,
+		WaitForReady: true,
+	})
+	assert.NoError(t, err)
+	defer r.Close()
+
+	select {
+	case <-r.Ready():
+	default:
+		t.Fatal("resolver should be ready")
+	}
+	assert.NoError(t, r.WaitReady(context.Background()))
+}
+
+func TestServiceResolverInitTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	client, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
+	assert.NoError(t, err)
+
+	conf := ResolverConfig{
+		ServiceSpec: ServiceSpec{ServiceName: "service"},
+		Client:      client,
+		InitTimeout: 100 * time.Millisecond,
+	}
+
+	r, err := NewConsulResolver(context.Background(), conf)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	_, err = r.Resolve(context.Background())
+	assert.ErrorIs(t, err, ErrNotInitialized)
+
+	// once the timeout elapsed, Resolve should fail immediately
+	start := time.Now()
+	_, err = r.Resolve(context.Background())
+	assert.ErrorIs(t, err, ErrNotInitialized)
+	assert.Less(t, int64(time.Since(start)), int64(10*time.Millisecond))
+
+	conf.WaitForReady = true
+	_, err = NewConsulResolver(context.Background(), conf)
+	assert.ErrorIs(t, err, ErrNotInitialized)
+}
+
+func TestServiceResolverConsistencyModes(t *testing.T) {
+	client, fake := newFakeConsulClient(t)
+
+	options := &api.QueryOptions{WaitIndex: 10, Filter: "Service.Port == 8080"}
+	r, err := NewConsulResolver(context.Background(), ResolverConfig{
+		ServiceSpec:  ServiceSpec{ServiceName: "service"},
+		Client:       client,
+		Query:        options,
+		AllowStale:   true,
+		UseCache:     true,
+		CacheMaxAge:  time.Minute,
+		WaitForReady: true,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	fake.mu.Lock()
+	query, header := fake.lastQuery, fake.lastHeader
+	fake.mu.Unlock()
+	assert.Contains(t, query, "stale")
+	assert.Contains(t, query, "cached")
+	assert.Equal(t, "max-age=60", header.Get("Cache-Control"))
+	// the caller's query options are left untouched
+	assert.Equal(t, &api.QueryOptions{WaitIndex: 10, Filter: "Service.Port == 8080"}, options)
+
+	status := r.Status()
+	require.Len(t, status, 1)
+	assert.Equal(t, 1, status[0].Instances)
+	assert.NotNil(t, status[0].QueryMeta)
+	assert.WithinDuration(t, time.Now(), status[0].LastSuccess, time.Minute)
+}
+
+func TestServiceResolverMaxLastContact(t *testing.T) {
+	client, fake := newFakeConsulClient(t)
+	fake.lastContact = time.Minute
+
+	r, err := NewConsulResolver(context.Background(), ResolverConfig{
+		ServiceSpec:    ServiceSpec{ServiceName: "service"},
+		Client:         client,
+		AllowStale:     true,
+		MaxLastContact: time.Second,
+		InitTimeout:    500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	_, err = r.Resolve(context.Background())
+	assert.ErrorIs(t, err, ErrNotInitialized)
+
+	status := r.Status()
+	require.Len(t, status, 1)
+	require.NotNil(t, status[0].QueryMeta)
+	assert.Equal(t, time.Minute, status[0].QueryMeta.LastContact)
+	// rejected responses are not successful
+	assert.True(t, status[0].LastSuccess.IsZero())
+}
+
+func TestServiceResolverPreferStreaming(t *testing.T) {
+	tests := []struct {
+		name      string
+		streaming bool
+		agentDown bool
+		backend   QueryBackend
+	}{
+		{name: "streaming enabled", streaming: true, backend: QueryBackendStreaming},
+		{name: "streaming disabled", backend: QueryBackendBlocking},
+		{name: "agent unavailable", agentDown: true, backend: QueryBackendBlocking},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, fake := newFakeConsulClient(t)
+			fake.streaming = tt.streaming
+			fake.agentDown = tt.agentDown
+
+			r, err := NewConsulResolver(context.Background(), ResolverConfig{
+				ServiceSpec:     ServiceSpec{ServiceName: "service"},
+				Client:          client,
+				UseCache:        true,
+				PreferStreaming: true,
+				WaitForReady:    true,
+			})
+			require.NoError(t, err)
+			defer r.Close()
+
+			fake.mu.Lock()
+			query := fake.lastQuery
+			fake.mu.Unlock()
+			assert.Equal(t, tt.backend, r.Backend())
+			if tt.streaming {
+				assert.NotContains(t, query, "cached")
+			} else {
+				assert.Contains(t, query, "cached")
+			}
+		})
+	}
+}
+
+// fakeHealthAPI serves the Consul health endpoint, returning a single instance per service
+type fakeHealthAPI struct {
+	mu          sync.Mutex
+	queries     map[string]int // the queries received by the server
+	issued      map[string]int // the queries issued by the client, which may not have reached the server yet
+	lastQuery   url.Values
+	lastHeader  http.Header
+	lastContact time.Duration
+	streaming   bool
+	agentDown   bool
+	agentHangs  bool // agent queries block until they are canceled
+}
+
+func (f *fakeHealthAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/agent/self" {
+		f.mu.Lock()
+		agentDown, agentHangs := f.agentDown, f.agentHangs
+		f.queries["agent/self"]++
+		f.mu.Unlock()
+		if agentHangs {
+			<-r.Context().Done()
+			return
+		}
+		if agentDown {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	if r.URL.Path == "/v1/agent/self" {
+		_ = json.NewEncoder(w).Encode(map[string]map[string]interface{}{
+			"Config":      {"Datacenter": "dc1"},
+			"DebugConfig": {"UseStreamingBackend": f.streaming},
+		})
+		return
+	}
+
+	service := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	f.mu.Lock()
+	f.queries[service+"@"+r.URL.Query().Get("dc")]++
+	f.lastQuery = r.URL.Query()
+	f.lastHeader = r.Header
+	lastContact := f.lastContact
+	f.mu.Unlock()
+
+	if r.URL.Query().Get("index") != "" {
+		// block until the query is canceled or timed out
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}
+
+	w.Header().Set("X-Consul-Index", "1")
+	w.Header().Set("X-Consul-LastContact", strconv.FormatInt(lastContact.Milliseconds(), 10))
+	_ = json.NewEncoder(w).Encode([]*api.ServiceEntry{{
+		Node:    &api.Node{ID: "node", Address: "10.0.0.1"},
+		Service: &api.AgentService{Service: service, Port: 8080},
+	}})
+}
+
+func (f *fakeHealthAPI) queriesFor(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries[key]
+}
+
+// issuedFor returns the number of queries issued by the client, which unlike the queries received by the server
+// are final once the go routines querying Consul exit
+func (f *fakeHealthAPI) issuedFor(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.issued[key]
+}
+
+// issue wraps the client transport, counting the queries it issues
+func (f *fakeHealthAPI) issue(next http.RoundTripper) http.RoundTripper {
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		f.mu.Lock()
+		f.issued[strings.TrimPrefix(req.URL.Path, "/v1/health/service/")+"@"+req.URL.Query().Get("dc")]++
+		f.mu.Unlock()
+		return next.RoundTrip(req)
+	})
+}
+
+func newFakeConsulClient(t *testing.T) (*api.Client, *fakeHealthAPI) {
+	fake := &fakeHealthAPI{queries: map[string]int{}, issued: map[string]int{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	client, err := api.NewClient(&api.Config{
+		Address:    srv.Listener.Addr().String(),
+		HttpClient: &http.Client{Transport: fake.issue(http.DefaultTransport)},
+	})
+	require.NoError(t, err)
+	return client, fake
+}
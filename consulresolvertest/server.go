@@ -0,0 +1,754 @@
+// Package consulresolvertest provides an in-process fake of the Consul HTTP API endpoints used by resolvers,
+// for testing code that uses resolvers without running Consul.
+//
+// The fake serves the health service endpoint (including blocking queries with Consul's index semantics),
+// the agent self, service registration and deregistration endpoints, and the catalog and coordinate endpoints.
+// Instances may be registered, deregistered and have their health flipped at runtime, and faults (latency,
+// errors, stale responses and index resets) may be injected.
+package consulresolvertest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/serf/coordinate"
+)
+
+const (
+	defaultDatacenter = "dc1"
+	defaultWait       = 5 * time.Minute
+	maxWait           = 10 * time.Minute
+)
+
+// Config configures a Server
+type Config struct {
+	// The name of the local datacenter, reported by the agent self endpoint and used for instances without a datacenter
+	// Optional
+	// Default: dc1
+	Datacenter string
+	// Additional datacenters known to the server. Datacenters of registered instances are always known,
+	// while queries of unknown datacenters fail like they do in Consul.
+	// Optional
+	Datacenters []string
+	// Reported by the agent self endpoint, for testing resolvers that prefer the streaming backend
+	// Optional
+	// Default: false
+	UseStreamingBackend bool
+}
+
+// Instance is an instance of a service registered with the server
+type Instance struct {
+	// The ID of the instance, which must be unique within its datacenter
+	// Mandatory
+	ID string
+	// The name of the service
+	// Mandatory
+	Service string
+	// The address of the instance
+	// Mandatory
+	Address string
+	// The port of the instance
+	// Mandatory
+	Port int
+	// The name of the node running the instance
+	// Optional
+	// Default: the address
+	Node string
+	// The tags of the instance
+	// Optional
+	Tags []string
+	// The meta of the instance
+	// Optional
+	Meta map[string]string
+	// The weight of the instance when it is passing
+	// Optional
+	// Default: 1
+	Weight int
+	// The status of the instance's health check, one of api.HealthPassing, api.HealthWarning and api.HealthCritical
+	// Optional
+	// Default: api.HealthPassing
+	Status string
+	// The datacenter of the instance
+	// Optional
+	// Default: the local datacenter
+	Datacenter string
+}
+
+// Faults are injected into the responses of the server
+type Faults struct {
+	// A delay added to every request, before it is handled
+	Latency time.Duration
+	// If not 0, requests fail with this status code (e.g. http.StatusInternalServerError) instead of being handled
+	StatusCode int
+	// The number of requests failing with StatusCode, or 0 for failing all requests until the faults are changed
+	Count int
+	// Reported as the time since the last contact with the leader (X-Consul-LastContact)
+	LastContact time.Duration
+	// If true, the responses report that there is no known leader (X-Consul-KnownLeader)
+	NoLeader bool
+}
+
+// Server is an in-process fake of the Consul HTTP API
+type Server struct {
+	// The URL of the server, e.g. http://127.0.0.1:12345
+	URL string
+
+	srv        *httptest.Server
+	datacenter string
+	streaming  bool
+
+	mu          sync.Mutex
+	changed     chan struct{} // closed and replaced whenever the state changes
+	index       uint64
+	datacenters map[string]*datacenterState
+	faults      Faults
+	requests    map[string]int
+}
+
+type datacenterState struct {
+	// the instances of every service, by ID
+	services map[string]map[string]*registration
+	// the index of the last change of every service
+	indexes map[string]uint64
+}
+
+type registration struct {
+	Instance
+	createIndex uint64
+	modifyIndex uint64
+}
+
+// NewServer starts a new Server, which must be closed once done
+func NewServer(conf Config) *Server {
+	if conf.Datacenter == "" {
+		conf.Datacenter = defaultDatacenter
+	}
+
+	s := &Server{
+		datacenter:  conf.Datacenter,
+		streaming:   conf.UseStreamingBackend,
+		changed:     make(chan struct{}),
+		index:       1,
+		datacenters: map[string]*datacenterState{},
+		requests:    map[string]int{},
+	}
+	s.datacenterState(conf.Datacenter)
+	for _, dc := range conf.Datacenters {
+		s.datacenterState(dc)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/health/service/", s.handleHealthService)
+	mux.HandleFunc("/v1/agent/self", s.handleAgentSelf)
+	mux.HandleFunc("/v1/agent/service/register", s.handleAgentRegister)
+	mux.HandleFunc("/v1/agent/service/deregister/", s.handleAgentDeregister)
+	mux.HandleFunc("/v1/catalog/datacenters", s.handleCatalogDatacenters)
+	mux.HandleFunc("/v1/catalog/services", s.handleCatalogServices)
+	mux.HandleFunc("/v1/catalog/service/", s.handleCatalogService)
+	mux.HandleFunc("/v1/coordinate/datacenters", s.handleCoordinateDatacenters)
+	mux.HandleFunc("/v1/coordinate/nodes", s.handleCoordinateNodes)
+
+	s.srv = httptest.NewServer(s.withFaults(mux))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts the server down, ending any blocking query
+func (s *Server) Close() {
+	s.srv.CloseClientConnections()
+	s.srv.Close()
+}
+
+// Client returns a new Consul client of the server
+func (s *Server) Client() *api.Client {
+	conf := api.DefaultConfig()
+	conf.Address = s.URL
+	conf.Token = ""
+	client, err := api.NewClient(conf)
+	if err != nil {
+		// the config has no TLS or transport options that may fail
+		panic(err)
+	}
+	return client
+}
+
+// Datacenter returns the name of the local datacenter
+func (s *Server) Datacenter() string {
+	return s.datacenter
+}
+
+// Register adds the instance, or replaces the instance with the same ID in its datacenter
+func (s *Server) Register(instance Instance) {
+	if instance.Datacenter == "" {
+		instance.Datacenter = s.datacenter
+	}
+	if instance.Node == "" {
+		instance.Node = instance.Address
+	}
+	if instance.Weight <= 0 {
+		instance.Weight = 1
+	}
+	if instance.Status == "" {
+		instance.Status = api.HealthPassing
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dc := s.datacenterState(instance.Datacenter)
+	instances, ok := dc.services[instance.Service]
+	if !ok {
+		instances = map[string]*registration{}
+		dc.services[instance.Service] = instances
+	}
+
+	index := s.nextIndex()
+	reg := &registration{Instance: instance, createIndex: index, modifyIndex: index}
+	if prev, ok := instances[instance.ID]; ok {
+		reg.createIndex = prev.createIndex
+	}
+	// the ID is unique within the datacenter, so an instance registered with a different service is moved
+	for service, others := range dc.services {
+		if _, ok := others[instance.ID]; ok && service != instance.Service {
+			delete(others, instance.ID)
+			dc.indexes[service] = index
+		}
+	}
+	instances[instance.ID] = reg
+	dc.indexes[instance.Service] = index
+	s.notify()
+}
+
+// Deregister removes the instance with the given ID from the given datacenter (an empty string for the local datacenter).
+// It returns false if there is no such instance.
+func (s *Server) Deregister(datacenter, id string) bool {
+	if datacenter == "" {
+		datacenter = s.datacenter
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dc, ok := s.datacenters[datacenter]
+	if !ok {
+		return false
+	}
+	for service, instances := range dc.services {
+		if _, ok := instances[id]; ok {
+			delete(instances, id)
+			dc.indexes[service] = s.nextIndex()
+			s.notify()
+			return true
+		}
+	}
+	return false
+}
+
+// SetHealth sets the status of the health check of the instance with the given ID in the given datacenter
+// (an empty string for the local datacenter) to api.HealthPassing, api.HealthWarning or api.HealthCritical.
+// It returns false if there is no such instance.
+func (s *Server) SetHealth(datacenter, id, status string) bool {
+	if datacenter == "" {
+		datacenter = s.datacenter
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dc, ok := s.datacenters[datacenter]
+	if !ok {
+		return false
+	}
+	for service, instances := range dc.services {
+		if reg, ok := instances[id]; ok {
+			if reg.Status == status {
+				return true
+			}
+			index := s.nextIndex()
+			reg.Status = status
+			reg.modifyIndex = index
+			dc.indexes[service] = index
+			s.notify()
+			return true
+		}
+	}
+	return false
+}
+
+// SetFaults replaces the faults injected into the responses of the server. The zero Faults clears them.
+func (s *Server) SetFaults(faults Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = faults
+}
+
+// ResetIndex resets the Raft index to 1, as happens when Consul's state is restored from a snapshot.
+// Blocking queries return immediately, with an index lower than the one they waited on.
+func (s *Server) ResetIndex() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index = 1
+	for _, dc := range s.datacenters {
+		for service := range dc.indexes {
+			dc.indexes[service] = 1
+		}
+		for _, instances := range dc.services {
+			for _, reg := range instances {
+				reg.createIndex, reg.modifyIndex = 1, 1
+			}
+		}
+	}
+	s.notify()
+}
+
+// Requests returns the number of requests received for the given path, e.g. /v1/health/service/orders
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// datacenterState returns the state of the given datacenter, creating it if needed. s.mu must be held.
+func (s *Server) datacenterState(name string) *datacenterState {
+	dc, ok := s.datacenters[name]
+	if !ok {
+		dc = &datacenterState{services: map[string]map[string]*registration{}, indexes: map[string]uint64{}}
+		s.datacenters[name] = dc
+	}
+	return dc
+}
+
+// nextIndex increments the Raft index. s.mu must be held.
+func (s *Server) nextIndex() uint64 {
+	s.index++
+	return s.index
+}
+
+// notify wakes up the blocking queries. s.mu must be held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// withFaults counts the requests and injects the configured faults before handling them
+func (s *Server) withFaults(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		s.requests[req.URL.Path]++
+		faults := s.faults
+		if faults.StatusCode != 0 && faults.Count > 0 {
+			s.faults.Count--
+			if s.faults.Count == 0 {
+				s.faults.StatusCode = 0
+			}
+		}
+		s.mu.Unlock()
+
+		if faults.Latency > 0 {
+			timer := time.NewTimer(faults.Latency)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+
+		if faults.StatusCode != 0 {
+			http.Error(w, "injected fault", faults.StatusCode)
+			return
+		}
+
+		w.Header().Set("X-Consul-KnownLeader", strconv.FormatBool(!faults.NoLeader))
+		w.Header().Set("X-Consul-LastContact", strconv.FormatInt(faults.LastContact.Milliseconds(), 10))
+		next.ServeHTTP(w, req)
+	})
+}
+
+// blockingQuery writes the result of the query once the index of the given service changes compared to the
+// request's index, or once the request's wait time elapses. Like Consul, an index lower than the requested index
+// (e.g. after an index reset) is returned immediately.
+func (s *Server) blockingQuery(w http.ResponseWriter, req *http.Request, query func() (interface{}, uint64, error)) {
+	q := req.URL.Query()
+	var minIndex uint64
+	if v := q.Get("index"); v != "" {
+		index, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid index", http.StatusBadRequest)
+			return
+		}
+		minIndex = index
+	}
+	wait := defaultWait
+	if v := q.Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "Invalid wait time", http.StatusBadRequest)
+			return
+		}
+		wait = d
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for {
+		s.mu.Lock()
+		res, index, err := query()
+		changed := s.changed
+		s.mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if minIndex == 0 || index != minIndex {
+			writeJSON(w, res, index)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			writeJSON(w, res, index)
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// lookupDatacenter returns the state of the requested datacenter. s.mu must be held.
+func (s *Server) lookupDatacenter(req *http.Request) (*datacenterState, string, error) {
+	name := req.URL.Query().Get("dc")
+	if name == "" {
+		name = s.datacenter
+	}
+	dc, ok := s.datacenters[name]
+	if !ok {
+		return nil, name, errNoPath
+	}
+	return dc, name, nil
+}
+
+// serviceIndex returns the index of the given service, which is never 0. s.mu must be held.
+func serviceIndex(dc *datacenterState, service string) uint64 {
+	if index := dc.indexes[service]; index > 0 {
+		return index
+	}
+	return 1
+}
+
+// sortedInstances returns the instances of the service ordered by ID. s.mu must be held.
+func sortedInstances(dc *datacenterState, service string) []*registration {
+	res := make([]*registration, 0, len(dc.services[service]))
+	for _, reg := range dc.services[service] {
+		res = append(res, reg)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+func (s *Server) handleHealthService(w http.ResponseWriter, req *http.Request) {
+	service := strings.TrimPrefix(req.URL.Path, "/v1/health/service/")
+	q := req.URL.Query()
+	if q.Get("filter") != "" {
+		http.Error(w, "filter expressions are not supported by the fake server", http.StatusBadRequest)
+		return
+	}
+	tags := q["tag"]
+	_, passingOnly := q["passing"]
+
+	s.blockingQuery(w, req, func() (interface{}, uint64, error) {
+		dc, name, err := s.lookupDatacenter(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries := make([]*api.ServiceEntry, 0)
+		for _, reg := range sortedInstances(dc, service) {
+			if !hasTags(reg.Tags, tags) || (passingOnly && reg.Status != api.HealthPassing) {
+				continue
+			}
+			entries = append(entries, reg.entry(name))
+		}
+		return entries, serviceIndex(dc, service), nil
+	})
+}
+
+func (s *Server) handleCatalogService(w http.ResponseWriter, req *http.Request) {
+	service := strings.TrimPrefix(req.URL.Path, "/v1/catalog/service/")
+	tags := req.URL.Query()["tag"]
+
+	s.blockingQuery(w, req, func() (interface{}, uint64, error) {
+		dc, name, err := s.lookupDatacenter(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		services := make([]*api.CatalogService, 0)
+		for _, reg := range sortedInstances(dc, service) {
+			if !hasTags(reg.Tags, tags) {
+				continue
+			}
+			services = append(services, reg.catalogService(name))
+		}
+		return services, serviceIndex(dc, service), nil
+	})
+}
+
+func (s *Server) handleCatalogServices(w http.ResponseWriter, req *http.Request) {
+	s.blockingQuery(w, req, func() (interface{}, uint64, error) {
+		dc, _, err := s.lookupDatacenter(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		services := map[string][]string{}
+		var index uint64 = 1
+		for service, instances := range dc.services {
+			if len(instances) == 0 {
+				continue
+			}
+			tags := []string{}
+			seen := map[string]bool{}
+			for _, reg := range instances {
+				for _, tag := range reg.Tags {
+					if !seen[tag] {
+						seen[tag] = true
+						tags = append(tags, tag)
+					}
+				}
+			}
+			sort.Strings(tags)
+			services[service] = tags
+		}
+		for _, i := range dc.indexes {
+			if i > index {
+				index = i
+			}
+		}
+		return services, index, nil
+	})
+}
+
+func (s *Server) handleCatalogDatacenters(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	names := s.datacenterNames()
+	index := s.index
+	s.mu.Unlock()
+	writeJSON(w, names, index)
+}
+
+func (s *Server) handleCoordinateDatacenters(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	names := s.datacenterNames()
+	s.mu.Unlock()
+
+	res := make([]api.CoordinateDatacenterMap, 0, len(names))
+	for _, name := range names {
+		res = append(res, api.CoordinateDatacenterMap{
+			Datacenter:  name,
+			AreaID:      "wan",
+			Coordinates: []api.CoordinateEntry{{Node: "consul-server-" + name, Coord: coordinate.NewCoordinate(coordinate.DefaultConfig())}},
+		})
+	}
+	writeJSON(w, res, 0)
+}
+
+func (s *Server) handleCoordinateNodes(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	dc, _, err := s.lookupDatacenter(req)
+	if err != nil {
+		s.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nodes := map[string]bool{}
+	for _, instances := range dc.services {
+		for _, reg := range instances {
+			nodes[reg.Node] = true
+		}
+	}
+	index := s.index
+	s.mu.Unlock()
+
+	res := make([]*api.CoordinateEntry, 0, len(nodes))
+	for node := range nodes {
+		res = append(res, &api.CoordinateEntry{Node: node, Coord: coordinate.NewCoordinate(coordinate.DefaultConfig())})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Node < res[j].Node
+	})
+	writeJSON(w, res, index)
+}
+
+func (s *Server) handleAgentSelf(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"Config": map[string]interface{}{
+			"Datacenter": s.datacenter,
+			"NodeName":   "consul-agent",
+		},
+		"DebugConfig": map[string]interface{}{
+			"UseStreamingBackend": s.streaming,
+		},
+	}, 0)
+}
+
+func (s *Server) handleAgentRegister(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var reg api.AgentServiceRegistration
+	if err := json.NewDecoder(req.Body).Decode(&reg); err != nil {
+		http.Error(w, "Request decode failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reg.Name == "" {
+		http.Error(w, "Missing service name", http.StatusBadRequest)
+		return
+	}
+
+	instance := Instance{
+		ID:      reg.ID,
+		Service: reg.Name,
+		Address: reg.Address,
+		Port:    reg.Port,
+		Node:    "consul-agent",
+		Tags:    reg.Tags,
+		Meta:    reg.Meta,
+	}
+	if instance.ID == "" {
+		instance.ID = reg.Name
+	}
+	if reg.Weights != nil {
+		instance.Weight = reg.Weights.Passing
+	}
+	s.Register(instance)
+}
+
+func (s *Server) handleAgentDeregister(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(req.URL.Path, "/v1/agent/service/deregister/")
+	if !s.Deregister("", id) {
+		http.Error(w, "Unknown service ID "+strconv.Quote(id), http.StatusNotFound)
+	}
+}
+
+// datacenterNames returns the names of the known datacenters, the local one first. s.mu must be held.
+func (s *Server) datacenterNames() []string {
+	names := make([]string, 0, len(s.datacenters))
+	for name := range s.datacenters {
+		if name != s.datacenter {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{s.datacenter}, names...)
+}
+
+func (r *registration) entry(datacenter string) *api.ServiceEntry {
+	return &api.ServiceEntry{
+		Node: &api.Node{
+			ID:          r.Node,
+			Node:        r.Node,
+			Address:     r.Address,
+			Datacenter:  datacenter,
+			CreateIndex: r.createIndex,
+			ModifyIndex: r.createIndex,
+		},
+		Service: &api.AgentService{
+			ID:          r.ID,
+			Service:     r.Service,
+			Tags:        r.Tags,
+			Meta:        r.Meta,
+			Port:        r.Port,
+			Address:     r.Address,
+			Weights:     api.AgentWeights{Passing: r.Weight, Warning: 1},
+			Datacenter:  datacenter,
+			CreateIndex: r.createIndex,
+			ModifyIndex: r.modifyIndex,
+		},
+		Checks: api.HealthChecks{
+			{
+				Node:        r.Node,
+				CheckID:     "serfHealth",
+				Name:        "Serf Health Status",
+				Status:      api.HealthPassing,
+				CreateIndex: r.createIndex,
+				ModifyIndex: r.createIndex,
+			},
+			{
+				Node:        r.Node,
+				CheckID:     "service:" + r.ID,
+				Name:        "Service '" + r.Service + "' check",
+				Status:      r.Status,
+				ServiceID:   r.ID,
+				ServiceName: r.Service,
+				ServiceTags: r.Tags,
+				CreateIndex: r.createIndex,
+				ModifyIndex: r.modifyIndex,
+			},
+		},
+	}
+}
+
+func (r *registration) catalogService(datacenter string) *api.CatalogService {
+	return &api.CatalogService{
+		ID:             r.Node,
+		Node:           r.Node,
+		Address:        r.Address,
+		Datacenter:     datacenter,
+		ServiceID:      r.ID,
+		ServiceName:    r.Service,
+		ServiceAddress: r.Address,
+		ServiceTags:    r.Tags,
+		ServiceMeta:    r.Meta,
+		ServicePort:    r.Port,
+		ServiceWeights: api.Weights{Passing: r.Weight, Warning: 1},
+		CreateIndex:    r.createIndex,
+		ModifyIndex:    r.modifyIndex,
+	}
+}
+
+type serverError string
+
+func (e serverError) Error() string {
+	return string(e)
+}
+
+// errNoPath is returned for queries of unknown datacenters, like Consul does
+const errNoPath = serverError("No path to datacenter")
+
+func hasTags(tags, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, t := range tags {
+			if t == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}, index uint64) {
+	w.Header().Set("Content-Type", "application/json")
+	if index > 0 {
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	}
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,210 @@
+package consulresolvertest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	consulresolver "github.com/AppsFlyer/go-consul-resolver"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const eventually = 5 * time.Second
+
+func newResolver(t *testing.T, s *Server, conf consulresolver.ResolverConfig) *consulresolver.ServiceResolver {
+	conf.Client = s.Client()
+	conf.Log = t.Logf
+	conf.WaitForReady = true
+	conf.InitTimeout = eventually
+	r, err := consulresolver.NewConsulResolver(context.Background(), conf)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = r.Close()
+	})
+	return r
+}
+
+func resolvesTo(r *consulresolver.ServiceResolver, addrs ...consulresolver.ServiceAddress) func() bool {
+	return func() bool {
+		res, err := r.ResolveAll(context.Background())
+		if err != nil || len(res) != len(addrs) {
+			return false
+		}
+		for i := range res {
+			if res[i] != addrs[i] {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func TestServerRegistrationAndHealth(t *testing.T) {
+	s := NewServer(Config{})
+	defer s.Close()
+	s.Register(Instance{ID: "a", Service: "orders", Address: "10.0.0.1", Port: 8080, Tags: []string{"v2"}})
+	s.Register(Instance{ID: "b", Service: "orders", Address: "10.0.0.2", Port: 8080, Tags: []string{"v1"}})
+
+	r := newResolver(t, s, consulresolver.ResolverConfig{ServiceSpec: consulresolver.ServiceSpec{ServiceName: "orders", Tags: []string{"v2"}}})
+	assert.Condition(t, resolvesTo(r, consulresolver.ServiceAddress{Host: "10.0.0.1", Port: 8080}))
+
+	s.Register(Instance{ID: "c", Service: "orders", Address: "10.0.0.3", Port: 8080, Tags: []string{"v2"}})
+	assert.Eventually(t, resolvesTo(r, consulresolver.ServiceAddress{Host: "10.0.0.1", Port: 8080}, consulresolver.ServiceAddress{Host: "10.0.0.3", Port: 8080}), eventually, 10*time.Millisecond)
+
+	require.True(t, s.SetHealth("", "a", api.HealthCritical))
+	assert.Eventually(t, resolvesTo(r, consulresolver.ServiceAddress{Host: "10.0.0.3", Port: 8080}), eventually, 10*time.Millisecond)
+
+	require.True(t, s.SetHealth("", "a", api.HealthPassing))
+	require.True(t, s.Deregister("", "c"))
+	assert.Eventually(t, resolvesTo(r, consulresolver.ServiceAddress{Host: "10.0.0.1", Port: 8080}), eventually, 10*time.Millisecond)
+
+	assert.False(t, s.Deregister("", "c"))
+	assert.False(t, s.SetHealth("dc9", "a", api.HealthPassing))
+}
+
+func TestServerDatacenterFailover(t *testing.T) {
+	s := NewServer(Config{Datacenter: "dc1", Datacenters: []string{"dc2"}})
+	defer s.Close()
+	s.Register(Instance{ID: "local", Service: "orders", Address: "10.0.0.1", Port: 8080})
+	s.Register(Instance{ID: "remote", Service: "orders", Address: "10.1.0.1", Port: 8080, Datacenter: "dc2"})
+
+	r := newResolver(t, s, consulresolver.ResolverConfig{
+		ServiceSpec:         consulresolver.ServiceSpec{ServiceName: "orders"},
+		FallbackDatacenters: []string{"dc1", "dc2"},
+	})
+	// the resolver is ready once any datacenter responds, so the local datacenter may be used only later
+	assert.Eventually(t, resolvesTo(r, consulresolver.ServiceAddress{Host: "10.0.0.1", Port: 8080}), eventually, 10*time.Millisecond)
+	// the local datacenter, determined using the agent self endpoint, is not queried twice
+	assert.Len(t, r.Status(), 2)
+
+	s.SetHealth("", "local", api.HealthWarning)
+	assert.Eventually(t, resolvesTo(r, consulresolver.ServiceAddress{Host: "10.1.0.1", Port: 8080}), eventually, 10*time.Millisecond)
+
+	s.SetHealth("", "local", api.HealthPassing)
+	assert.Eventually(t, resolvesTo(r, consulresolver.ServiceAddress{Host: "10.0.0.1", Port: 8080}), eventually, 10*time.Millisecond)
+}
+
+func TestServerFaults(t *testing.T) {
+	s := NewServer(Config{})
+	defer s.Close()
+	s.Register(Instance{ID: "a", Service: "orders", Address: "10.0.0.1", Port: 8080})
+
+	r := newResolver(t, s, consulresolver.ResolverConfig{ServiceSpec: consulresolver.ServiceSpec{ServiceName: "orders"}})
+	assert.Condition(t, resolvesTo(r, consulresolver.ServiceAddress{Host: "10.0.0.1", Port: 8080}))
+
+	// failing queries keep the last targets, and recover once the faults are over
+	s.SetFaults(Faults{StatusCode: http.StatusInternalServerError, Count: 2})
+	s.Register(Instance{ID: "b", Service: "orders", Address: "10.0.0.2", Port: 8080})
+	assert.Condition(t, resolvesTo(r, consulresolver.ServiceAddress{Host: "10.0.0.1", Port: 8080}))
+	assert.Eventually(t, resolvesTo(r, consulresolver.ServiceAddress{Host: "10.0.0.1", Port: 8080}, consulresolver.ServiceAddress{Host: "10.0.0.2", Port: 8080}), eventually, 10*time.Millisecond)
+
+	// the resolver keeps watching after the index goes backwards
+	s.ResetIndex()
+	s.Deregister("", "b")
+	assert.Eventually(t, resolvesTo(r, consulresolver.ServiceAddress{Host: "10.0.0.1", Port: 8080}), eventually, 10*time.Millisecond)
+	assert.Greater(t, s.Requests("/v1/health/service/orders"), 3)
+}
+
+func TestServerBlockingQueries(t *testing.T) {
+	s := NewServer(Config{})
+	defer s.Close()
+	s.Register(Instance{ID: "a", Service: "orders", Address: "10.0.0.1", Port: 8080, Meta: map[string]string{"zone": "a"}})
+	health := s.Client().Health()
+
+	entries, meta, err := health.Service("orders", "", true, nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "a", entries[0].Service.ID)
+	assert.Equal(t, "dc1", entries[0].Node.Datacenter)
+	assert.Equal(t, map[string]string{"zone": "a"}, entries[0].Service.Meta)
+	assert.True(t, meta.KnownLeader)
+	index := meta.LastIndex
+
+	// an unchanged service blocks until the wait time elapses
+	start := time.Now()
+	_, meta, err = health.Service("orders", "", true, &api.QueryOptions{WaitIndex: index, WaitTime: 100 * time.Millisecond})
+	require.NoError(t, err)
+	assert.Equal(t, index, meta.LastIndex)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// changes of other services do not end the query
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Register(Instance{ID: "x", Service: "billing", Address: "10.0.0.9", Port: 8080})
+		time.Sleep(50 * time.Millisecond)
+		s.SetHealth("", "a", api.HealthCritical)
+	}()
+	entries, meta, err = health.Service("orders", "", true, &api.QueryOptions{WaitIndex: index, WaitTime: time.Minute})
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Greater(t, meta.LastIndex, index)
+
+	entries, _, err = health.Service("orders", "", false, nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, api.HealthCritical, entries[0].Checks.AggregatedStatus())
+
+	s.SetFaults(Faults{Latency: 50 * time.Millisecond, LastContact: 3 * time.Second, NoLeader: true})
+	start = time.Now()
+	_, meta, err = health.Service("orders", "", false, nil)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, 3*time.Second, meta.LastContact)
+	assert.False(t, meta.KnownLeader)
+
+	s.SetFaults(Faults{StatusCode: http.StatusServiceUnavailable})
+	_, _, err = health.Service("orders", "", false, nil)
+	assert.Error(t, err)
+	_, _, err = health.Service("orders", "", false, nil)
+	assert.Error(t, err)
+
+	s.SetFaults(Faults{})
+	_, _, err = health.Service("orders", "", false, &api.QueryOptions{Datacenter: "dc9"})
+	assert.Error(t, err)
+}
+
+func TestServerAgentAndCatalog(t *testing.T) {
+	s := NewServer(Config{Datacenters: []string{"dc2"}})
+	defer s.Close()
+	client := s.Client()
+
+	require.NoError(t, client.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		ID: "1", Name: "hello-service", Address: "service_1", Port: 8080, Tags: []string{"v1"},
+	}))
+
+	services, _, err := client.Catalog().Service("hello-service", "", nil)
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, "service_1", services[0].ServiceAddress)
+	assert.Equal(t, []string{"v1"}, services[0].ServiceTags)
+
+	all, _, err := client.Catalog().Services(nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"hello-service": {"v1"}}, all)
+
+	dcs, err := client.Catalog().Datacenters()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dc1", "dc2"}, dcs)
+
+	self, err := client.Agent().Self()
+	require.NoError(t, err)
+	assert.Equal(t, "dc1", self["Config"]["Datacenter"])
+
+	nodes, _, err := client.Coordinate().Nodes(nil)
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+	assert.NotNil(t, nodes[0].Coord)
+
+	areas, err := client.Coordinate().Datacenters()
+	require.NoError(t, err)
+	assert.Len(t, areas, 2)
+
+	require.NoError(t, client.Agent().ServiceDeregister("1"))
+	services, _, err = client.Catalog().Service("hello-service", "", nil)
+	require.NoError(t, err)
+	assert.Empty(t, services)
+	assert.Error(t, client.Agent().ServiceDeregister("1"))
+}
@@ -0,0 +1,238 @@
+package consulresolver
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const maxRecentErrors = 10
+
+// BalancerDebugger may be implemented by a Balancer for exposing its internal state (e.g. weights, ejections or scores)
+// in the debug handler. The returned value must be JSON serializable.
+type BalancerDebugger interface {
+	DebugState() interface{}
+}
+
+// DiscoveryError is an error returned when querying the discovery backend for the instances of a datacenter
+type DiscoveryError struct {
+	Time       time.Time `json:"time"`
+	Datacenter string    `json:"datacenter"`
+	Error      string    `json:"error"`
+}
+
+// ResolverDebugInfo describes the state of a resolver
+type ResolverDebugInfo struct {
+	ServiceName string `json:"service_name"`
+	// The type of the resolver
+	Type string `json:"type"`
+	// The following fields are only set for a ServiceResolver
+	Spec             *ServiceSpec          `json:"spec,omitempty"`
+	Backend          QueryBackend          `json:"backend,omitempty"`
+	Ready            bool                  `json:"ready"`
+	ActiveDatacenter *string               `json:"active_datacenter,omitempty"`
+	Datacenters      []DatacenterDebugInfo `json:"datacenters,omitempty"`
+	Balancer         string                `json:"balancer,omitempty"`
+	BalancerState    interface{}           `json:"balancer_state,omitempty"`
+	RecentErrors     []DiscoveryError      `json:"recent_errors,omitempty"`
+}
+
+// DatacenterDebugInfo describes the state of the watch on a single datacenter
+type DatacenterDebugInfo struct {
+	// The name of the datacenter, or an empty string for the local datacenter
+	Name      string `json:"name"`
+	Priority  int    `json:"priority"`
+	Active    bool   `json:"active"`
+	Stale     bool   `json:"stale"`
+	LastIndex uint64 `json:"last_index"`
+	// The time since the last contact of the Consul server with the leader, as reported by the last response (i.e. its staleness)
+	LastContact string `json:"last_contact,omitempty"`
+	// The time of the last successful response from the discovery backend, or nil if none was received yet
+	LastSuccess *time.Time          `json:"last_success,omitempty"`
+	KnownLeader bool                `json:"known_leader"`
+	CacheHit    bool                `json:"cache_hit"`
+	Instances   []InstanceDebugInfo `json:"instances"`
+}
+
+// InstanceDebugInfo describes a single instance of a service
+type InstanceDebugInfo struct {
+	ID      string            `json:"id"`
+	Node    string            `json:"node"`
+	Address string            `json:"address"`
+	Port    int               `json:"port"`
+	Tags    []string          `json:"tags,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Weight  int               `json:"weight"`
+}
+
+// Debug returns the state of the resolver, including the instances of every datacenter and the state of its balancer
+func (r *ServiceResolver) Debug() ResolverDebugInfo {
+	spec := r.spec
+	info := ResolverDebugInfo{
+		ServiceName: r.spec.ServiceName,
+		Type:        fmt.Sprintf("%T", r),
+		Spec:        &spec,
+		Backend:     r.backend,
+		Balancer:    fmt.Sprintf("%T", r.balancer),
+	}
+	select {
+	case <-r.init:
+		info.Ready = true
+	default:
+	}
+	if d, ok := r.balancer.(BalancerDebugger); ok {
+		info.BalancerState = d.DebugState()
+	}
+
+	r.targetsMu.Lock()
+	active := r.activePriority
+	r.targetsMu.Unlock()
+	if active >= 0 {
+		name := r.datacenterName(active)
+		info.ActiveDatacenter = &name
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for priority, name := range r.datacenters {
+		dc := DatacenterDebugInfo{
+			Name:      name,
+			Priority:  priority,
+			Active:    priority == active,
+			Stale:     r.stale[priority],
+			Instances: make([]InstanceDebugInfo, 0, len(r.prioritizedInstances[priority])),
+		}
+		if priority < len(r.lastSuccess) && !r.lastSuccess[priority].IsZero() {
+			lastSuccess := r.lastSuccess[priority]
+			dc.LastSuccess = &lastSuccess
+		}
+		if meta := r.queryMeta[priority]; meta != nil {
+			dc.LastIndex = meta.LastIndex
+			dc.LastContact = meta.LastContact.String()
+			dc.KnownLeader = meta.KnownLeader
+			dc.CacheHit = meta.CacheHit
+		}
+		for _, e := range r.prioritizedInstances[priority] {
+			addr := r.addressOf(e)
+			instance := InstanceDebugInfo{Address: addr.Host, Port: addr.Port}
+			if e.Node != nil {
+				instance.Node = e.Node.Node
+			}
+			if e.Service != nil {
+				instance.ID = e.Service.ID
+				instance.Tags = e.Service.Tags
+				instance.Meta = e.Service.Meta
+				instance.Weight = e.Service.Weights.Passing
+			}
+			dc.Instances = append(dc.Instances, instance)
+		}
+		info.Datacenters = append(info.Datacenters, dc)
+	}
+	info.RecentErrors = append([]DiscoveryError(nil), r.recentErrors...)
+	return info
+}
+
+// recordError keeps the given discovery error of the datacenter, dropping the oldest error if there are too many
+func (r *ServiceResolver) recordError(priority int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.recentErrors) == maxRecentErrors {
+		r.recentErrors = r.recentErrors[1:]
+	}
+	r.recentErrors = append(r.recentErrors, DiscoveryError{
+		Time:       time.Now(),
+		Datacenter: r.datacenterName(priority),
+		Error:      err.Error(),
+	})
+}
+
+// NewDebugHandler creates an http.Handler describing the state of every resolver registered with the given transport
+// (or dialer), which may be mounted under a path such as `/debug/consul-resolver`.
+// The state is rendered as JSON if the `format=json` query parameter is set or JSON is accepted, and as HTML otherwise.
+func NewDebugHandler(source interface{ Resolvers() []Resolver }) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		resolvers := source.Resolvers()
+		infos := make([]ResolverDebugInfo, 0, len(resolvers))
+		for _, r := range resolvers {
+			if sr, ok := r.(*ServiceResolver); ok {
+				infos = append(infos, sr.Debug())
+				continue
+			}
+			infos = append(infos, ResolverDebugInfo{ServiceName: r.ServiceName(), Type: fmt.Sprintf("%T", r)})
+		}
+		sort.SliceStable(infos, func(i, j int) bool {
+			return infos[i].ServiceName < infos[j].ServiceName
+		})
+
+		if req.URL.Query().Get("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			_ = enc.Encode(infos)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = debugTemplate.Execute(w, infos)
+	})
+}
+
+var debugTemplate = template.Must(template.New("debug").Funcs(template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.MarshalIndent(v, "", "  ")
+		return string(b), err
+	},
+	"dc": func(name interface{}) string {
+		if p, ok := name.(*string); ok {
+			name = *p
+		}
+		if name == "" {
+			return "(local)"
+		}
+		return fmt.Sprint(name)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Consul Resolvers</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; vertical-align: top; }
+.active { background: #e6ffe6; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Consul Resolvers</h1>
+{{range .}}
+<h2>{{.ServiceName}}</h2>
+<p>Type: {{.Type}}{{if .Spec}} | Ready: {{.Ready}} | Backend: {{.Backend}} | Active datacenter: {{if .ActiveDatacenter}}{{dc .ActiveDatacenter}}{{else}}none{{end}} | Balancer: {{.Balancer}}{{end}}</p>
+{{if .Spec}}
+<p>Tags: {{.Spec.Tags}} | Include unhealthy: {{.Spec.IncludeUnhealthy}}{{if .Spec.ServicePort}} | Port override: {{.Spec.ServicePort}}{{end}}</p>
+{{range .Datacenters}}
+<h3{{if .Active}} class="active"{{end}}>Datacenter {{dc .Name}} (priority {{.Priority}}{{if .Active}}, active{{end}}{{if .Stale}}, stale{{end}})</h3>
+<p>Last success: {{if .LastSuccess}}{{.LastSuccess.Format "2006-01-02T15:04:05Z07:00"}}{{else}}never{{end}} | Last index: {{.LastIndex}} | Last contact: {{.LastContact}} | Known leader: {{.KnownLeader}} | Cache hit: {{.CacheHit}}</p>
+<table>
+<tr><th>ID</th><th>Node</th><th>Address</th><th>Port</th><th>Weight</th><th>Tags</th><th>Meta</th></tr>
+{{range .Instances}}<tr><td>{{.ID}}</td><td>{{.Node}}</td><td>{{.Address}}</td><td>{{.Port}}</td><td>{{.Weight}}</td><td>{{.Tags}}</td><td>{{.Meta}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .BalancerState}}<h3>Balancer state</h3>
+<pre>{{json .BalancerState}}</pre>{{end}}
+{{if .RecentErrors}}<h3>Recent errors</h3>
+<table>
+<tr><th>Time</th><th>Datacenter</th><th>Error</th></tr>
+{{range .RecentErrors}}<tr class="error"><td>{{.Time.Format "2006-01-02T15:04:05Z07:00"}}</td><td>{{dc .Datacenter}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>{{end}}
+{{end}}
+{{else}}
+<p>No resolvers are registered.</p>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,88 @@
+package consulresolver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AppsFlyer/go-consul-resolver/lb"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugHandler(t *testing.T) {
+	r := &ServiceResolver{
+		ctx:                  context.Background(),
+		logger:               newLogger(nil, nil),
+		metrics:              noopMetrics{},
+		tracer:               newTracer(nil),
+		balancer:             &lb.WeightedRoundRobinLoadBalancer{},
+		spec:                 ServiceSpec{ServiceName: "orders", Tags: []string{"v2"}},
+		datacenters:          []string{"", "dc2"},
+		prioritizedInstances: make([][]*api.ServiceEntry, 2),
+		stale:                make([]bool, 2),
+		queryMeta:            make([]*api.QueryMeta, 2),
+		lastSuccess:          make([]time.Time, 2),
+		init:                 make(chan struct{}),
+		activePriority:       -1,
+	}
+	dcSubscriber{resolver: r, priority: 0}.onError(errors.New("connection refused"))
+	dcSubscriber{resolver: r, priority: 1}.onUpdate([]*api.ServiceEntry{newTestEntry("node2", "b", 8080)}, &api.QueryMeta{LastIndex: 42, KnownLeader: true})
+
+	transport, err := NewLoadBalancedTransport(TransportConfig{Resolvers: []Resolver{r, &staticNameResolver{name: "billing"}}})
+	require.NoError(t, err)
+	handler := NewDebugHandler(transport)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/consul-resolver?format=json", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var infos []ResolverDebugInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &infos))
+	require.Len(t, infos, 2)
+	assert.Equal(t, "billing", infos[0].ServiceName)
+	assert.Nil(t, infos[0].Spec)
+
+	info := infos[1]
+	assert.Equal(t, "orders", info.ServiceName)
+	assert.True(t, info.Ready)
+	require.NotNil(t, info.ActiveDatacenter)
+	assert.Equal(t, "dc2", *info.ActiveDatacenter)
+	assert.Equal(t, "*lb.WeightedRoundRobinLoadBalancer", info.Balancer)
+	assert.NotNil(t, info.BalancerState)
+	require.Len(t, info.Datacenters, 2)
+	assert.Empty(t, info.Datacenters[0].Instances)
+	assert.False(t, info.Datacenters[0].Active)
+	assert.True(t, info.Datacenters[1].Active)
+	assert.Equal(t, uint64(42), info.Datacenters[1].LastIndex)
+	assert.Nil(t, info.Datacenters[0].LastSuccess)
+	require.NotNil(t, info.Datacenters[1].LastSuccess)
+	assert.WithinDuration(t, time.Now(), *info.Datacenters[1].LastSuccess, time.Minute)
+	assert.Equal(t, []InstanceDebugInfo{{ID: "b", Node: "node2", Address: "node2", Port: 8080}}, info.Datacenters[1].Instances)
+	require.Len(t, info.RecentErrors, 1)
+	assert.Equal(t, "", info.RecentErrors[0].Datacenter)
+	assert.Equal(t, "connection refused", info.RecentErrors[0].Error)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/consul-resolver", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, rec.Body.String(), "<h2>orders</h2>")
+	assert.Contains(t, rec.Body.String(), "Active datacenter: dc2")
+	assert.Contains(t, rec.Body.String(), "connection refused")
+	assert.Contains(t, rec.Body.String(), "Last success: never")
+}
+
+func TestServiceResolverKeepsRecentErrors(t *testing.T) {
+	r := &ServiceResolver{datacenters: []string{""}}
+	for i := 0; i < maxRecentErrors+5; i++ {
+		r.recordError(0, errors.New("failure"))
+	}
+	assert.Len(t, r.recentErrors, maxRecentErrors)
+}
@@ -0,0 +1,97 @@
+package consulresolver
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/friendsofgo/errors"
+)
+
+// LoadBalancedDialer resolves service addresses at dial time, leaving the requested address untouched.
+// Its DialContext method can be plugged into http.Transport, database drivers, Redis clients or any code that accepts a dial function.
+type LoadBalancedDialer struct {
+	resolvers        *resolverRegistry
+	dial             DialFn
+	logger           Logger
+	resolverFallback bool
+}
+
+func NewLoadBalancedDialer(conf DialerConfig) (*LoadBalancedDialer, error) {
+
+	if len(conf.Resolvers) == 0 && len(conf.HostResolvers) == 0 && conf.LazyResolvers == nil {
+		return nil, errors.New("no resolver provided")
+	}
+
+	logger := withComponent(newLogger(conf.Logger, conf.Log), componentDialer)
+
+	if conf.Dial == nil {
+		conf.Dial = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+
+	lazy, err := newLazyResolvers(conf.LazyResolvers, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoadBalancedDialer{
+		resolvers:        newResolverRegistry(conf.Resolvers, conf.HostResolvers, conf.HostMatchers, lazy),
+		dial:             conf.Dial,
+		logger:           logger,
+		resolverFallback: conf.NetResolverFallback,
+	}, nil
+}
+
+// DialContext connects to an instance of the service matching the host part of addr.
+// Addresses that do not match any resolver are dialed as is.
+func (d *LoadBalancedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	r, ok := d.resolvers.lookup(ctx, addr)
+	if !ok {
+		d.logger.Log(LevelDebug, "no resolver found for address", Field{Key: FieldHost, Value: addr})
+		return d.dial(ctx, network, addr)
+	}
+
+	tgt, err := r.Resolve(ctx)
+	if err != nil {
+		if d.resolverFallback {
+			d.logger.Log(LevelWarn, "failed resolving target, falling back to default resolver", serviceField(r.ServiceName()), errorField(err))
+			return d.dial(ctx, network, addr)
+		}
+		d.logger.Log(LevelError, "failed resolving target", serviceField(r.ServiceName()), errorField(err))
+		return nil, err
+	}
+
+	return d.dial(ctx, network, net.JoinHostPort(tgt.Host, strconv.Itoa(tgt.Port)))
+}
+
+// AddResolver registers a resolver with the dialer.
+// If a resolver with the same service name and datacenter is already registered, it is replaced, and closed if it implements io.Closer.
+// It is safe to call AddResolver concurrently with in-flight requests.
+func (d *LoadBalancedDialer) AddResolver(r Resolver) {
+	d.resolvers.add(r)
+}
+
+// RemoveResolver unregisters the given resolver, and closes it if it implements io.Closer.
+// It returns false if the resolver is not registered.
+// Resolvers are matched by identity, so resolvers of non-comparable types (e.g. structs holding a slice, rather than
+// pointers) cannot be removed.
+func (d *LoadBalancedDialer) RemoveResolver(r Resolver) bool {
+	return d.resolvers.remove(r)
+}
+
+// Resolvers returns all the resolvers registered with the dialer, including the ones created on demand
+func (d *LoadBalancedDialer) Resolvers() []Resolver {
+	return d.resolvers.list()
+}
+
+// Close closes all the resolvers registered with the dialer that implement io.Closer, including the ones created on demand.
+// Connections dialed after Close will use the original address.
+func (d *LoadBalancedDialer) Close() error {
+	d.resolvers.close()
+	return nil
+}
@@ -0,0 +1,114 @@
+package consulresolver
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/friendsofgo/errors"
+	"github.com/stretchr/testify/suite"
+)
+
+type DialerTestSuite struct {
+	suite.Suite
+	resolver *MockResolver
+	srv      *httptest.Server
+	dialed   []string
+}
+
+func (t *DialerTestSuite) SetupTest() {
+	t.resolver = &MockResolver{}
+	t.dialed = nil
+	t.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Host)
+	}))
+}
+
+func (t *DialerTestSuite) TearDownTest() {
+	t.srv.Close()
+}
+
+func TestDialerTestSuite(t *testing.T) {
+	suite.Run(t, new(DialerTestSuite))
+}
+
+func (t *DialerTestSuite) TestDialResolvedAddress() {
+	t.resolver.On("ServiceName").Return(serviceName)
+	t.resolver.On("Resolve").Return(t.serverAddress(), nil)
+
+	d := t.newDialer(false)
+	conn, err := d.DialContext(context.Background(), "tcp", "test-service:80")
+	t.Require().NoError(err)
+	conn.Close()
+
+	t.Assert().Equal([]string{t.srv.Listener.Addr().String()}, t.dialed)
+	t.resolver.AssertExpectations(t.T())
+}
+
+func (t *DialerTestSuite) TestDialUnknownHost() {
+	t.resolver.On("ServiceName").Return(serviceName)
+
+	d := t.newDialer(false)
+	conn, err := d.DialContext(context.Background(), "tcp", t.srv.Listener.Addr().String())
+	t.Require().NoError(err)
+	conn.Close()
+
+	t.Assert().Equal([]string{t.srv.Listener.Addr().String()}, t.dialed)
+	t.resolver.AssertNotCalled(t.T(), "Resolve")
+}
+
+func (t *DialerTestSuite) TestDialResolverError() {
+	t.resolver.On("ServiceName").Return(serviceName)
+	t.resolver.On("Resolve").Return(ServiceAddress{}, errors.New("failed"))
+
+	d := t.newDialer(false)
+	_, err := d.DialContext(context.Background(), "tcp", "test-service:80")
+	t.Assert().Error(err)
+	t.Assert().Empty(t.dialed)
+}
+
+func (t *DialerTestSuite) TestDialFallbackOnError() {
+	t.resolver.On("ServiceName").Return(serviceName)
+	t.resolver.On("Resolve").Return(ServiceAddress{}, errors.New("failed"))
+
+	d := t.newDialer(true)
+	_, _ = d.DialContext(context.Background(), "tcp", "test-service:80")
+	t.Assert().Equal([]string{"test-service:80"}, t.dialed)
+}
+
+func (t *DialerTestSuite) TestHTTPTransportKeepsRequestHost() {
+	t.resolver.On("ServiceName").Return(serviceName)
+	t.resolver.On("Resolve").Return(t.serverAddress(), nil)
+
+	d := t.newDialer(false)
+	client := &http.Client{Transport: &http.Transport{DialContext: d.DialContext}}
+	res, err := client.Get("http://test-service/do/something")
+	t.Require().NoError(err)
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	t.Require().NoError(err)
+	t.Assert().Equal("test-service", string(body))
+}
+
+func (t *DialerTestSuite) newDialer(fallback bool) *LoadBalancedDialer {
+	base := &net.Dialer{}
+	d, err := NewLoadBalancedDialer(DialerConfig{
+		Resolvers:           []Resolver{t.resolver},
+		NetResolverFallback: fallback,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			t.dialed = append(t.dialed, addr)
+			return base.DialContext(ctx, network, addr)
+		},
+	})
+	t.Require().NoError(err)
+	return d
+}
+
+func (t *DialerTestSuite) serverAddress() ServiceAddress {
+	addr := t.srv.Listener.Addr().(*net.TCPAddr)
+	return ServiceAddress{Host: addr.IP.String(), Port: addr.Port}
+}
@@ -0,0 +1,196 @@
+package consulresolver
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Discovery is a service discovery backend, providing the instances of services.
+// Consul's Health API is the default backend, but any source of instances (DNS, static lists, files, etc.) may be
+// plugged into a resolver, reusing its datacenter failover and balancing.
+type Discovery interface {
+	// Watch returns the instances matching the request, along with an index describing their state.
+	// When the request's WaitIndex is not 0, implementations should block until the instances change compared to it,
+	// until their next refresh is due (e.g. a DNS TTL), or until the context is done.
+	// Implementations that cannot block may return immediately, in which case they will be polled once per second.
+	Watch(ctx context.Context, req DiscoveryRequest) (*DiscoveryResult, error)
+}
+
+// DiscoveryRequest describes the instances requested from a Discovery
+type DiscoveryRequest struct {
+	// The name of the service
+	ServiceName string
+	// The tags the instances must have
+	Tags []string
+	// If true, unhealthy instances should be returned as well
+	IncludeUnhealthy bool
+	// The datacenter to discover the instances in, or an empty string for the local datacenter
+	Datacenter string
+	// The index returned by the previous call, or 0 for the first call
+	WaitIndex uint64
+}
+
+// DiscoveryResult holds the instances returned by a Discovery
+type DiscoveryResult struct {
+	// The discovered instances. Only Node.Node, Node.Address, Service.ID, Service.Address, Service.Port, Service.Meta
+	// and Service.Weights are used by the resolver and the bundled balancers.
+	Instances []*api.ServiceEntry
+	// An index describing the state of the instances, which should change whenever they do
+	Index uint64
+	// The meta of the Consul response, or nil for other backends
+	QueryMeta *api.QueryMeta
+}
+
+// ConsulDiscovery discovers instances using blocking queries to Consul's Health API
+type ConsulDiscovery struct {
+	provider       ServiceProvider
+	client         *api.Client
+	query          api.QueryOptions
+	maxLastContact time.Duration
+}
+
+// NewConsulDiscovery creates a Discovery backed by Consul's Health API
+// client - the consul client
+// query - the query options used for every query, optional
+func NewConsulDiscovery(client *api.Client, query *api.QueryOptions) *ConsulDiscovery {
+	var q api.QueryOptions
+	if query != nil {
+		q = *query
+	}
+	return newConsulDiscovery(client.Health(), client, q, 0)
+}
+
+func newConsulDiscovery(provider ServiceProvider, client *api.Client, q api.QueryOptions, maxLastContact time.Duration) *ConsulDiscovery {
+	q.WaitIndex = 0
+	q.Datacenter = ""
+	return &ConsulDiscovery{
+		provider:       provider,
+		client:         client,
+		query:          q,
+		maxLastContact: maxLastContact,
+	}
+}
+
+// Watch runs a blocking query for the instances of the requested service
+func (d *ConsulDiscovery) Watch(ctx context.Context, req DiscoveryRequest) (*DiscoveryResult, error) {
+	q := *d.query.WithContext(ctx)
+	q.Datacenter = req.Datacenter
+	q.WaitIndex = req.WaitIndex
+
+	se, meta, err := d.provider.ServiceMultipleTags(req.ServiceName, req.Tags, !req.IncludeUnhealthy, &q)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.maxLastContact > 0 && meta.LastContact > d.maxLastContact {
+		return nil, &StaleResponseError{QueryMeta: meta}
+	}
+
+	return &DiscoveryResult{Instances: se, Index: meta.LastIndex, QueryMeta: meta}, nil
+}
+
+// StaleResponseError is returned by ConsulDiscovery when a response is rejected, since the last contact of the
+// responding server with the leader exceeds the configured MaxLastContact
+type StaleResponseError struct {
+	// The meta of the rejected response
+	QueryMeta *api.QueryMeta
+}
+
+func (e *StaleResponseError) Error() string {
+	return fmt.Sprintf("rejecting stale consul response, last contact with leader was %s ago", e.QueryMeta.LastContact)
+}
+
+// consulWatchKey identifies the Consul queries that are equivalent for a WatcherPool
+type consulWatchKey struct {
+	provider       ServiceProvider
+	client         *api.Client
+	filter         string
+	namespace      string
+	token          string
+	allowStale     bool
+	consistent     bool
+	useCache       bool
+	maxAge         time.Duration
+	staleIfError   time.Duration
+	waitTime       time.Duration
+	near           string
+	nodeMeta       string
+	relayFactor    uint8
+	localOnly      bool
+	connect        bool
+	maxLastContact time.Duration
+}
+
+func (d *ConsulDiscovery) watchKey() interface{} {
+	key := consulWatchKey{
+		client:         d.client,
+		filter:         d.query.Filter,
+		namespace:      d.query.Namespace,
+		token:          d.query.Token,
+		allowStale:     d.query.AllowStale,
+		consistent:     d.query.RequireConsistent,
+		useCache:       d.query.UseCache,
+		maxAge:         d.query.MaxAge,
+		staleIfError:   d.query.StaleIfError,
+		waitTime:       d.query.WaitTime,
+		near:           d.query.Near,
+		nodeMeta:       encodeNodeMeta(d.query.NodeMeta),
+		relayFactor:    d.query.RelayFactor,
+		localOnly:      d.query.LocalOnly,
+		connect:        d.query.Connect,
+		maxLastContact: d.maxLastContact,
+	}
+	// a client creates a new Health endpoint on every call, so the client identifies the provider if one is known
+	if d.client == nil {
+		key.provider = d.provider
+	}
+	return key
+}
+
+// encodeNodeMeta returns a comparable encoding of the given node meta filter
+func encodeNodeMeta(meta map[string]string) string {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(strconv.Quote(k))
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(meta[k]))
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+// InstancesIndex returns a non-zero hash of the given (sorted) instances, which changes whenever they do.
+// It may be used by Discovery implementations that have no index of their own.
+func InstancesIndex(instances []*api.ServiceEntry) uint64 {
+	h := fnv.New64a()
+	for _, instance := range instances {
+		s := instance.Service
+		_, _ = fmt.Fprintf(h, "%s|%s|%d|%d|%s", s.ID, s.Address, s.Port, s.Weights.Passing, strings.Join(s.Tags, ","))
+		keys := make([]string, 0, len(s.Meta))
+		for k := range s.Meta {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			_, _ = fmt.Fprintf(h, "|%s=%s", k, s.Meta[k])
+		}
+		_, _ = h.Write([]byte{'\n'})
+	}
+	if index := h.Sum64(); index != 0 {
+		return index
+	}
+	return 1
+}
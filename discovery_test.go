@@ -0,0 +1,116 @@
+package consulresolver
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mapDiscovery serves the instances of every datacenter from a map, and counts the calls made per datacenter
+type mapDiscovery struct {
+	mu        sync.Mutex
+	instances map[string][]*api.ServiceEntry
+	calls     map[string]int
+}
+
+func (d *mapDiscovery) Watch(_ context.Context, req DiscoveryRequest) (*DiscoveryResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls[req.Datacenter]++
+	return &DiscoveryResult{Instances: d.instances[req.Datacenter], Index: 1}, nil
+}
+
+func TestResolverWithCustomDiscovery(t *testing.T) {
+	discovery := &mapDiscovery{
+		instances: map[string][]*api.ServiceEntry{
+			"dc2": {newTestEntry("node-1", "1", 8080)},
+		},
+		calls: map[string]int{},
+	}
+
+	r, err := NewConsulResolver(context.Background(), ResolverConfig{
+		ServiceSpec:         ServiceSpec{ServiceName: "service"},
+		Discovery:           discovery,
+		Datacenter:          "dc1",
+		FallbackDatacenters: []string{"dc2"},
+		WaitForReady:        true,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	// the primary datacenter has no instances, so the resolver fails over to dc2
+	assert.Eventually(t, func() bool {
+		addr, err := r.Resolve(context.Background())
+		return err == nil && addr == ServiceAddress{Host: "node-1", Port: 8080}
+	}, time.Second, 10*time.Millisecond)
+
+	status := r.Status()
+	require.Len(t, status, 2)
+	assert.Nil(t, status[1].QueryMeta)
+	assert.Equal(t, 1, status[1].Instances)
+}
+
+func TestResolverRequiresClientOrDiscovery(t *testing.T) {
+	_, err := NewConsulResolver(context.Background(), ResolverConfig{ServiceSpec: ServiceSpec{ServiceName: "service"}})
+	assert.Error(t, err)
+}
+
+func TestWatcherPoolSharesCustomDiscovery(t *testing.T) {
+	discovery := &mapDiscovery{
+		instances: map[string][]*api.ServiceEntry{"": {newTestEntry("node-1", "1", 8080)}},
+		calls:     map[string]int{},
+	}
+	pool := NewWatcherPool()
+
+	for i := 0; i < 2; i++ {
+		r, err := NewConsulResolver(context.Background(), ResolverConfig{
+			ServiceSpec:  ServiceSpec{ServiceName: "service"},
+			Discovery:    discovery,
+			WatcherPool:  pool,
+			WaitForReady: true,
+		})
+		require.NoError(t, err)
+		defer r.Close()
+	}
+	assert.Equal(t, 1, pool.size())
+}
+
+func TestConsulWatchKeyCoversQueryOptions(t *testing.T) {
+	// the options set per request, which are not part of the key
+	perRequest := map[string]bool{"Datacenter": true, "WaitIndex": true, "WaitHash": true}
+
+	base := newConsulDiscovery(nil, &api.Client{}, api.QueryOptions{}, 0).watchKey()
+	typ := reflect.TypeOf(api.QueryOptions{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" || perRequest[field.Name] {
+			continue
+		}
+
+		var q api.QueryOptions
+		v := reflect.ValueOf(&q).Elem().Field(i)
+		switch v.Kind() {
+		case reflect.String:
+			v.SetString("x")
+		case reflect.Bool:
+			v.SetBool(true)
+		case reflect.Int64:
+			v.SetInt(1)
+		case reflect.Uint8:
+			v.SetUint(1)
+		case reflect.Map:
+			v.Set(reflect.ValueOf(map[string]string{"k": "v"}))
+		default:
+			t.Fatalf("unexpected kind %s of QueryOptions.%s", v.Kind(), field.Name)
+		}
+		// a new option changing the result set must be added to the key, or exclude the query from pooling
+		key := newConsulDiscovery(nil, base.(consulWatchKey).client, q, 0).watchKey()
+		assert.NotEqual(t, base, key, "QueryOptions.%s is not part of the watch key", field.Name)
+	}
+}
@@ -0,0 +1,252 @@
+package consulresolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AppsFlyer/go-consul-resolver/lb"
+	"github.com/friendsofgo/errors"
+	"github.com/hashicorp/consul/api"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultDNSMinTTL  = 5 * time.Second
+	defaultDNSMaxTTL  = 5 * time.Minute
+	defaultDNSTimeout = 5 * time.Second
+)
+
+// DNSDiscovery discovers instances using DNS SRV records, refreshing them whenever their TTL expires.
+// Only the records with the lowest SRV priority are used, so that records with higher priorities act as failover tiers,
+// and the SRV weight of every record is reported as its `Service.Weights`.
+// The service name of the request is used as the SRV name (e.g. `_http._tcp.orders.service.consul`), unless SRVName is provided.
+type DNSDiscovery struct {
+	// The address (host:port) of the DNS server to query.
+	// Optional
+	// Default: the first nameserver in /etc/resolv.conf
+	Server string
+	// A function returning the SRV name to query for the given request, which may be used for mapping datacenters to names.
+	// Optional
+	// Default: the request's service name
+	SRVName func(req DiscoveryRequest) string
+	// The minimal duration between refreshes, used when the records have a lower (or zero) TTL, or do not exist.
+	// Optional
+	// Default: 5 seconds
+	MinTTL time.Duration
+	// The maximal duration between refreshes.
+	// Optional
+	// Default: 5 minutes
+	MaxTTL time.Duration
+	// The timeout of a single DNS query.
+	// Optional
+	// Default: 5 seconds
+	Timeout time.Duration
+
+	mu        sync.Mutex
+	server    string
+	refreshAt map[string]time.Time
+}
+
+// NewDNSResolver creates a resolver watching the DNS SRV records of the config's ServiceSpec.
+// Unless provided, the config's Discovery defaults to a DNSDiscovery using the system's nameserver,
+// and its Balancer defaults to a WeightedRoundRobinLoadBalancer honoring the SRV weights.
+func NewDNSResolver(ctx context.Context, conf ResolverConfig) (*ServiceResolver, error) {
+	if conf.Discovery == nil {
+		conf.Discovery = &DNSDiscovery{}
+	}
+	if conf.Balancer == nil {
+		conf.Balancer = &lb.WeightedRoundRobinLoadBalancer{}
+	}
+	return NewConsulResolver(ctx, conf)
+}
+
+// Watch looks up the SRV records of the request. If the request has a WaitIndex, Watch waits for the TTL of the previous
+// records to expire, and keeps refreshing them until they change.
+func (d *DNSDiscovery) Watch(ctx context.Context, req DiscoveryRequest) (*DiscoveryResult, error) {
+	name := req.ServiceName
+	if d.SRVName != nil {
+		name = d.SRVName(req)
+	}
+
+	for {
+		if req.WaitIndex != 0 {
+			if err := d.waitRefresh(ctx, name); err != nil {
+				return nil, err
+			}
+		}
+
+		instances, ttl, err := d.lookup(ctx, name, req.ServiceName)
+		if err != nil {
+			return nil, err
+		}
+		d.scheduleRefresh(name, ttl)
+
+		index := InstancesIndex(instances)
+		if index != req.WaitIndex {
+			return &DiscoveryResult{Instances: instances, Index: index}, nil
+		}
+	}
+}
+
+// lookup queries the SRV records of the given name, returning the instances of the lowest priority and the TTL of the records
+func (d *DNSDiscovery) lookup(ctx context.Context, name, service string) ([]*api.ServiceEntry, time.Duration, error) {
+	server, err := d.getServer()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeSRV)
+
+	client := &dns.Client{Timeout: d.timeout()}
+	resp, _, err := client.ExchangeContext(ctx, msg, server)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, msg, server)
+	}
+	if err != nil {
+		return nil, 0, errors.Wrap(err, fmt.Sprintf("failed querying SRV records of %s", name))
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		// a missing name has no instances, which allows failing over to other datacenters
+		return nil, d.minTTL(), nil
+	default:
+		return nil, 0, errors.Errorf("failed querying SRV records of %s: %s", name, dns.RcodeToString[resp.Rcode])
+	}
+
+	// prefer the addresses provided in the additional section over resolving the targets when dialing
+	addresses := map[string]string{}
+	for _, rr := range resp.Extra {
+		switch r := rr.(type) {
+		case *dns.A:
+			if _, ok := addresses[r.Hdr.Name]; !ok {
+				addresses[r.Hdr.Name] = r.A.String()
+			}
+		case *dns.AAAA:
+			if _, ok := addresses[r.Hdr.Name]; !ok {
+				addresses[r.Hdr.Name] = r.AAAA.String()
+			}
+		}
+	}
+
+	var records []*dns.SRV
+	ttl := d.maxTTL()
+	for _, rr := range resp.Answer {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		if len(records) > 0 && srv.Priority > records[0].Priority {
+			continue
+		}
+		if len(records) > 0 && srv.Priority < records[0].Priority {
+			records = records[:0]
+		}
+		records = append(records, srv)
+		if recordTTL := time.Duration(srv.Hdr.Ttl) * time.Second; recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+	if ttl < d.minTTL() {
+		ttl = d.minTTL()
+	}
+
+	instances := make([]*api.ServiceEntry, 0, len(records))
+	for _, srv := range records {
+		target := strings.TrimSuffix(srv.Target, ".")
+		address, ok := addresses[srv.Target]
+		if !ok {
+			address = target
+		}
+		instances = append(instances, &api.ServiceEntry{
+			Node: &api.Node{Node: target, Address: address},
+			Service: &api.AgentService{
+				ID:      net.JoinHostPort(target, strconv.Itoa(int(srv.Port))),
+				Service: service,
+				Address: address,
+				Port:    int(srv.Port),
+				Weights: api.AgentWeights{Passing: int(srv.Weight), Warning: int(srv.Weight)},
+			},
+		})
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Service.ID < instances[j].Service.ID
+	})
+
+	return instances, ttl, nil
+}
+
+func (d *DNSDiscovery) waitRefresh(ctx context.Context, name string) error {
+	d.mu.Lock()
+	refreshAt := d.refreshAt[name]
+	d.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(refreshAt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *DNSDiscovery) scheduleRefresh(name string, ttl time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.refreshAt == nil {
+		d.refreshAt = map[string]time.Time{}
+	}
+	d.refreshAt[name] = time.Now().Add(ttl)
+}
+
+func (d *DNSDiscovery) getServer() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.server != "" {
+		return d.server, nil
+	}
+
+	d.server = d.Server
+	if d.server == "" {
+		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return "", errors.Wrap(err, "failed reading the system's DNS configuration")
+		}
+		if len(conf.Servers) == 0 {
+			return "", errors.New("no nameservers found in the system's DNS configuration")
+		}
+		d.server = net.JoinHostPort(conf.Servers[0], conf.Port)
+	}
+	return d.server, nil
+}
+
+func (d *DNSDiscovery) minTTL() time.Duration {
+	if d.MinTTL > 0 {
+		return d.MinTTL
+	}
+	return defaultDNSMinTTL
+}
+
+func (d *DNSDiscovery) maxTTL() time.Duration {
+	if d.MaxTTL > 0 {
+		return d.MaxTTL
+	}
+	return defaultDNSMaxTTL
+}
+
+func (d *DNSDiscovery) timeout() time.Duration {
+	if d.Timeout > 0 {
+		return d.Timeout
+	}
+	return defaultDNSTimeout
+}
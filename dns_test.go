@@ -0,0 +1,126 @@
+package consulresolver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDNSServer serves SRV records, along with A records for their targets, from an in-process DNS server
+type fakeDNSServer struct {
+	mu      sync.Mutex
+	records map[string][]*dns.SRV
+	addr    string
+}
+
+func newFakeDNSServer(t *testing.T) *fakeDNSServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	f := &fakeDNSServer{records: map[string][]*dns.SRV{}, addr: pc.LocalAddr().String()}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(f.serve)}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return f
+}
+
+func (f *fakeDNSServer) set(name string, records ...*dns.SRV) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records[dns.Fqdn(name)] = records
+}
+
+func (f *fakeDNSServer) serve(w dns.ResponseWriter, req *dns.Msg) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	name := req.Question[0].Name
+	records, ok := f.records[name]
+	if !ok {
+		resp.Rcode = dns.RcodeNameError
+	}
+	for i, r := range records {
+		srv := *r
+		srv.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 0}
+		resp.Answer = append(resp.Answer, &srv)
+		resp.Extra = append(resp.Extra, &dns.A{
+			Hdr: dns.RR_Header{Name: srv.Target, Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.IPv4(10, 0, 0, byte(i+1)),
+		})
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func srvRecord(target string, priority, weight, port uint16) *dns.SRV {
+	return &dns.SRV{Target: dns.Fqdn(target), Priority: priority, Weight: weight, Port: port}
+}
+
+func TestDNSResolver(t *testing.T) {
+	server := newFakeDNSServer(t)
+	name := "_http._tcp.orders.service.consul"
+	server.set(name,
+		srvRecord("a.node.consul", 10, 5, 8080),
+		srvRecord("b.node.consul", 10, 1, 8081),
+		srvRecord("c.node.consul", 20, 1, 8082),
+	)
+
+	r, err := NewDNSResolver(context.Background(), ResolverConfig{
+		ServiceSpec:  ServiceSpec{ServiceName: name},
+		Discovery:    &DNSDiscovery{Server: server.addr, MinTTL: 10 * time.Millisecond},
+		WaitForReady: true,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	// only the records with the lowest priority are used
+	addrs, err := r.ResolveAll(context.Background())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []ServiceAddress{{Host: "10.0.0.1", Port: 8080}, {Host: "10.0.0.2", Port: 8081}}, addrs)
+
+	// the weights are honored by the default balancer
+	hits := map[int]int{}
+	for i := 0; i < 60; i++ {
+		addr, err := r.Resolve(context.Background())
+		require.NoError(t, err)
+		hits[addr.Port]++
+	}
+	assert.Equal(t, map[int]int{8080: 50, 8081: 10}, hits)
+
+	// once the lowest priority records are gone, the next tier is used
+	server.set(name, srvRecord("c.node.consul", 20, 1, 8082))
+	assert.Eventually(t, func() bool {
+		addrs, err := r.ResolveAll(context.Background())
+		return err == nil && len(addrs) == 1 && addrs[0] == ServiceAddress{Host: "10.0.0.1", Port: 8082}
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestDNSResolverDatacenterFailover(t *testing.T) {
+	server := newFakeDNSServer(t)
+	server.set("orders.dc2", srvRecord("a.node.dc2.consul", 1, 1, 8080))
+
+	r, err := NewDNSResolver(context.Background(), ResolverConfig{
+		ServiceSpec:         ServiceSpec{ServiceName: "orders"},
+		Datacenter:          "dc1",
+		FallbackDatacenters: []string{"dc2"},
+		Discovery: &DNSDiscovery{
+			Server:  server.addr,
+			SRVName: func(req DiscoveryRequest) string { return req.ServiceName + "." + req.Datacenter },
+		},
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	// dc1 does not exist, so the resolver fails over to dc2
+	assert.Eventually(t, func() bool {
+		addr, err := r.Resolve(context.Background())
+		return err == nil && addr == ServiceAddress{Host: "10.0.0.1", Port: 8080}
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,220 @@
+package consulresolver
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// TargetsChangeReason describes why the target set of a resolver changed
+type TargetsChangeReason string
+
+const (
+	// ReasonInitial is delivered upon subscription, describing the current target set
+	ReasonInitial TargetsChangeReason = "initial"
+	// ReasonUpdate denotes a change in the instances of the active datacenter
+	ReasonUpdate TargetsChangeReason = "update"
+	// ReasonFailover denotes a switch to a lower priority datacenter, since no higher priority datacenter has instances
+	ReasonFailover TargetsChangeReason = "failover"
+	// ReasonFailback denotes a switch back to a higher priority datacenter
+	ReasonFailback TargetsChangeReason = "failback"
+)
+
+// TargetsChangedEvent describes a change in the target set of a resolver
+type TargetsChangedEvent struct {
+	ServiceName string
+	Reason      TargetsChangeReason
+	// The datacenter the targets belong to, or an empty string for the local datacenter
+	Datacenter string
+	// The datacenter the previous targets belonged to
+	PreviousDatacenter string
+	// Instances that were added to the target set
+	Added []*api.ServiceEntry
+	// Instances that were removed from the target set
+	Removed []*api.ServiceEntry
+	// Instances whose details (e.g. tags, health checks or address) changed
+	Changed []*api.ServiceEntry
+	// The complete target set
+	Targets []*api.ServiceEntry
+}
+
+type subscription struct {
+	fn func(TargetsChangedEvent)
+
+	mu         sync.Mutex
+	pending    []TargetsChangedEvent
+	delivering bool
+	canceled   bool
+}
+
+// enqueue queues the event for delivery, and reports whether the caller should deliver the queued events,
+// since no other go routine is delivering them
+func (s *subscription) enqueue(event TargetsChangedEvent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.canceled {
+		return false
+	}
+	s.pending = append(s.pending, event)
+	if s.delivering {
+		return false
+	}
+	s.delivering = true
+	return true
+}
+
+// deliver calls the subscriber with the queued events, one at a time, until the queue is empty
+func (s *subscription) deliver() {
+	for {
+		s.mu.Lock()
+		if s.canceled || len(s.pending) == 0 {
+			s.pending = nil
+			s.delivering = false
+			s.mu.Unlock()
+			return
+		}
+		event := s.pending[0]
+		s.pending = s.pending[1:]
+		s.mu.Unlock()
+
+		s.fn(event)
+	}
+}
+
+func (s *subscription) cancel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.canceled = true
+	s.pending = nil
+}
+
+// Subscribe registers a function that is called whenever the resolver's target set changes.
+// If the resolver already has targets, fn is called with a ReasonInitial event before Subscribe returns.
+// Later events are delivered from a separate go routine, one at a time and in order, so a slow fn only delays its own
+// events, and fn may call the resolver (e.g. ResolveAll) or cancel its subscription.
+// The returned function cancels the subscription; an event that is already being delivered may still complete.
+func (r *ServiceResolver) Subscribe(fn func(TargetsChangedEvent)) (unsubscribe func()) {
+	sub := &subscription{fn: fn}
+
+	r.targetsMu.Lock()
+	r.subscriptions = append(r.subscriptions, sub)
+	targets, priority := r.activeTargets, r.activePriority
+	deliver := false
+	if len(targets) > 0 {
+		deliver = sub.enqueue(TargetsChangedEvent{
+			ServiceName: r.spec.ServiceName,
+			Reason:      ReasonInitial,
+			Datacenter:  r.datacenterName(priority),
+			Added:       targets,
+			Targets:     targets,
+		})
+	}
+	r.targetsMu.Unlock()
+
+	if deliver {
+		sub.deliver()
+	}
+
+	return func() {
+		sub.cancel()
+		r.targetsMu.Lock()
+		defer r.targetsMu.Unlock()
+		for i, s := range r.subscriptions {
+			if s == sub {
+				r.subscriptions = append(r.subscriptions[:i:i], r.subscriptions[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// setTargets updates the balancer with the targets of the given datacenter priority (-1 if there are no targets),
+// and notifies the subscribers of the change
+func (r *ServiceResolver) setTargets(targets []*api.ServiceEntry, priority int) {
+	r.targetsMu.Lock()
+
+	r.balancer.UpdateTargets(targets)
+
+	event := diffTargets(r.activeTargets, targets)
+	event.ServiceName = r.spec.ServiceName
+	event.Datacenter = r.datacenterName(priority)
+	event.PreviousDatacenter = r.datacenterName(r.activePriority)
+	switch {
+	case r.activePriority < 0 || priority < 0 || priority == r.activePriority:
+		event.Reason = ReasonUpdate
+	case priority > r.activePriority:
+		event.Reason = ReasonFailover
+	default:
+		event.Reason = ReasonFailback
+	}
+	if priority >= 0 && priority != r.activePriority {
+		reason := event.Reason
+		if r.activePriority < 0 {
+			reason = ReasonInitial
+		}
+		r.metrics.ActiveDatacenter(r.spec.ServiceName, event.PreviousDatacenter, event.Datacenter, reason)
+	}
+	r.activeTargets, r.activePriority = targets, priority
+
+	// the events are queued under the lock to keep their order, but delivered after it's released
+	var deliver []*subscription
+	for _, s := range r.subscriptions {
+		if s.enqueue(event) {
+			deliver = append(deliver, s)
+		}
+	}
+	r.targetsMu.Unlock()
+
+	for _, s := range deliver {
+		go s.deliver()
+	}
+}
+
+func (r *ServiceResolver) datacenterName(priority int) string {
+	if priority < 0 || priority >= len(r.datacenters) {
+		return ""
+	}
+	return r.datacenters[priority]
+}
+
+// diffTargets returns an event describing the instances added, removed and changed between the previous and current targets
+func diffTargets(previous, current []*api.ServiceEntry) TargetsChangedEvent {
+	event := TargetsChangedEvent{Targets: current}
+
+	prev := make(map[string]*api.ServiceEntry, len(previous))
+	for _, e := range previous {
+		prev[instanceKey(e)] = e
+	}
+
+	for _, e := range current {
+		key := instanceKey(e)
+		old, ok := prev[key]
+		switch {
+		case !ok:
+			event.Added = append(event.Added, e)
+		case !reflect.DeepEqual(old, e):
+			event.Changed = append(event.Changed, e)
+		}
+		delete(prev, key)
+	}
+
+	for _, e := range previous {
+		if _, ok := prev[instanceKey(e)]; ok {
+			event.Removed = append(event.Removed, e)
+		}
+	}
+	return event
+}
+
+// instanceKey returns a key identifying a service instance across updates
+func instanceKey(e *api.ServiceEntry) string {
+	var node, id string
+	if e.Node != nil {
+		node = e.Node.Node
+	}
+	if e.Service != nil {
+		id = e.Service.ID
+	}
+	return node + "/" + id
+}
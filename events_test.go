@@ -0,0 +1,188 @@
+package consulresolver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AppsFlyer/go-consul-resolver/lb"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffTargets(t *testing.T) {
+	a := newTestEntry("node1", "a", 8080)
+	b := newTestEntry("node2", "b", 8080)
+	c := newTestEntry("node3", "c", 8080)
+	bChanged := newTestEntry("node2", "b", 9090)
+
+	event := diffTargets([]*api.ServiceEntry{a, b}, []*api.ServiceEntry{bChanged, c})
+	assert.Equal(t, []*api.ServiceEntry{c}, event.Added)
+	assert.Equal(t, []*api.ServiceEntry{a}, event.Removed)
+	assert.Equal(t, []*api.ServiceEntry{bChanged}, event.Changed)
+	assert.Equal(t, []*api.ServiceEntry{bChanged, c}, event.Targets)
+
+	event = diffTargets([]*api.ServiceEntry{a}, []*api.ServiceEntry{a})
+	assert.Empty(t, event.Added)
+	assert.Empty(t, event.Removed)
+	assert.Empty(t, event.Changed)
+}
+
+func TestServiceResolverSubscribe(t *testing.T) {
+	r := &ServiceResolver{
+		logger:               newLogger(nil, nil),
+		metrics:              noopMetrics{},
+		tracer:               newTracer(nil),
+		balancer:             &lb.RoundRobinLoadBalancer{},
+		spec:                 ServiceSpec{ServiceName: "service"},
+		datacenters:          []string{"", "dc2"},
+		prioritizedInstances: make([][]*api.ServiceEntry, 2),
+		stale:                make([]bool, 2),
+		queryMeta:            make([]*api.QueryMeta, 2),
+		init:                 make(chan struct{}),
+		activePriority:       -1,
+	}
+
+	events := make(chan TargetsChangedEvent, 10)
+	unsubscribe := r.Subscribe(func(e TargetsChangedEvent) {
+		events <- e
+	})
+
+	local := newTestEntry("node1", "a", 8080)
+	remote := newTestEntry("node2", "b", 8080)
+
+	r.update(0, []*api.ServiceEntry{local}, &api.QueryMeta{})
+	r.update(1, []*api.ServiceEntry{remote}, &api.QueryMeta{})
+	r.update(0, nil, &api.QueryMeta{})
+	r.update(0, []*api.ServiceEntry{local}, &api.QueryMeta{})
+
+	event := receiveEvent(t, events)
+	assert.Equal(t, ReasonUpdate, event.Reason)
+	assert.Equal(t, []*api.ServiceEntry{local}, event.Added)
+
+	event = receiveEvent(t, events)
+	assert.Equal(t, ReasonFailover, event.Reason)
+	assert.Equal(t, "dc2", event.Datacenter)
+	assert.Equal(t, "", event.PreviousDatacenter)
+	assert.Equal(t, []*api.ServiceEntry{remote}, event.Added)
+	assert.Equal(t, []*api.ServiceEntry{local}, event.Removed)
+
+	event = receiveEvent(t, events)
+	assert.Equal(t, ReasonFailback, event.Reason)
+	assert.Equal(t, "", event.Datacenter)
+	assert.Equal(t, "dc2", event.PreviousDatacenter)
+
+	// new subscribers receive the current targets before Subscribe returns
+	var initial TargetsChangedEvent
+	r.Subscribe(func(e TargetsChangedEvent) {
+		initial = e
+	})
+	assert.Equal(t, ReasonInitial, initial.Reason)
+	assert.Equal(t, []*api.ServiceEntry{local}, initial.Targets)
+
+	unsubscribe()
+	r.update(0, nil, &api.QueryMeta{})
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event after unsubscribing: %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestServiceResolverSubscribeCallbacks(t *testing.T) {
+	r := &ServiceResolver{
+		ctx:                  context.Background(),
+		logger:               newLogger(nil, nil),
+		metrics:              noopMetrics{},
+		tracer:               newTracer(nil),
+		balancer:             &lb.RoundRobinLoadBalancer{},
+		spec:                 ServiceSpec{ServiceName: "service"},
+		datacenters:          []string{""},
+		prioritizedInstances: make([][]*api.ServiceEntry, 1),
+		stale:                make([]bool, 1),
+		queryMeta:            make([]*api.QueryMeta, 1),
+		init:                 make(chan struct{}),
+		activePriority:       -1,
+	}
+
+	// a blocked subscriber does not block updates or other subscribers
+	release := make(chan struct{})
+	defer close(release)
+	r.Subscribe(func(TargetsChangedEvent) {
+		<-release
+	})
+
+	// subscribers may call the resolver and cancel their subscription
+	resolved := make(chan []ServiceAddress, 1)
+	var unsubscribe func()
+	unsubscribe = r.Subscribe(func(TargetsChangedEvent) {
+		addrs, _ := r.ResolveAll(context.Background())
+		resolved <- addrs
+		unsubscribe()
+	})
+
+	r.update(0, []*api.ServiceEntry{newTestEntry("node1", "a", 8080)}, &api.QueryMeta{})
+	r.update(0, []*api.ServiceEntry{newTestEntry("node2", "b", 8080)}, &api.QueryMeta{})
+	select {
+	case addrs := <-resolved:
+		assert.NotEmpty(t, addrs)
+	case <-time.After(time.Second):
+		t.Fatal("subscriber was not called")
+	}
+	select {
+	case <-resolved:
+		t.Fatal("subscriber was called after unsubscribing")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func receiveEvent(t *testing.T, events <-chan TargetsChangedEvent) TargetsChangedEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event was delivered")
+		return TargetsChangedEvent{}
+	}
+}
+
+func newTestEntry(node, id string, port int) *api.ServiceEntry {
+	return &api.ServiceEntry{
+		Node:    &api.Node{ID: node, Node: node, Address: node},
+		Service: &api.AgentService{ID: id, Port: port},
+	}
+}
+
+func TestServiceResolverResolveAll(t *testing.T) {
+	r := &ServiceResolver{
+		ctx:                  context.Background(),
+		logger:               newLogger(nil, nil),
+		metrics:              noopMetrics{},
+		tracer:               newTracer(nil),
+		balancer:             &lb.RoundRobinLoadBalancer{},
+		spec:                 ServiceSpec{ServiceName: "service"},
+		datacenters:          []string{"", "dc2"},
+		prioritizedInstances: make([][]*api.ServiceEntry, 2),
+		stale:                make([]bool, 2),
+		queryMeta:            make([]*api.QueryMeta, 2),
+		init:                 make(chan struct{}),
+		activePriority:       -1,
+	}
+
+	r.update(1, []*api.ServiceEntry{newTestEntry("node3", "c", 8080)}, &api.QueryMeta{})
+	addrs, err := r.ResolveAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ServiceAddress{{Host: "node3", Port: 8080}}, addrs)
+
+	r.update(0, []*api.ServiceEntry{newTestEntry("node1", "a", 8080), newTestEntry("node2", "b", 8081)}, &api.QueryMeta{})
+	addrs, err = r.ResolveAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ServiceAddress{{Host: "node1", Port: 8080}, {Host: "node2", Port: 8081}}, addrs)
+
+	r.update(0, nil, &api.QueryMeta{})
+	r.update(1, nil, &api.QueryMeta{})
+	_, err = r.ResolveAll(context.Background())
+	assert.Error(t, err)
+}
@@ -6,10 +6,17 @@ require (
 	github.com/cenkalti/backoff/v4 v4.1.0
 	github.com/docker/go-connections v0.4.0
 	github.com/friendsofgo/errors v0.9.2
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/google/uuid v1.2.0
 	github.com/hashicorp/consul/api v1.8.1
-	github.com/mitchellh/mapstructure v1.5.0 // indirect
-	github.com/stretchr/testify v1.7.0
+	github.com/hashicorp/serf v0.9.5
+	github.com/miekg/dns v1.1.43
+	github.com/mitchellh/mapstructure v1.5.0
+	github.com/stretchr/testify v1.7.1
 	github.com/testcontainers/testcontainers-go v0.11.0
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
 	go.uber.org/ratelimit v0.1.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,81 @@
+package grpcresolver
+
+import (
+	"net"
+	"strconv"
+
+	consulresolver "github.com/AppsFlyer/go-consul-resolver"
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NewBalancerBuilder creates a gRPC balancer builder with the given name, which delegates picking among the ready
+// connections to a Balancer created by newBalancer whenever the set of ready connections changes.
+// The Balancer is provided with the instances backing the connections, so tag aware and weighted balancers work as usual.
+func NewBalancerBuilder(name string, newBalancer func() consulresolver.Balancer) balancer.Builder {
+	return base.NewBalancerBuilder(name, &pickerBuilder{newBalancer: newBalancer}, base.Config{HealthCheck: true})
+}
+
+// RegisterBalancer registers a balancer builder created by NewBalancerBuilder, which may then be selected using the
+// `loadBalancingConfig` of the gRPC service config
+func RegisterBalancer(name string, newBalancer func() consulresolver.Balancer) {
+	balancer.Register(NewBalancerBuilder(name, newBalancer))
+}
+
+type pickerBuilder struct {
+	newBalancer func() consulresolver.Balancer
+}
+
+func (p *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	subConns := make(map[*api.ServiceEntry]balancer.SubConn, len(info.ReadySCs))
+	targets := make([]*api.ServiceEntry, 0, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		entry := entryOf(sci.Address.Addr, sci.Address.Attributes.Value(instanceKey{}))
+		subConns[entry] = sc
+		targets = append(targets, entry)
+	}
+
+	b := p.newBalancer()
+	b.UpdateTargets(targets)
+	return &picker{balancer: b, subConns: subConns}
+}
+
+// entryOf returns the instance backing an address, or an instance describing the address if it was not provided by the resolver
+func entryOf(addr string, value interface{}) *api.ServiceEntry {
+	if instance, ok := value.(Instance); ok && instance.Entry != nil {
+		return instance.Entry
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	port, _ := strconv.Atoi(portStr)
+	return &api.ServiceEntry{
+		Node:    &api.Node{Node: host, Address: host},
+		Service: &api.AgentService{ID: addr, Address: host, Port: port},
+	}
+}
+
+type picker struct {
+	balancer consulresolver.Balancer
+	subConns map[*api.ServiceEntry]balancer.SubConn
+}
+
+func (p *picker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	entry, err := p.balancer.Select()
+	if err != nil {
+		return balancer.PickResult{}, status.Error(codes.Unavailable, err.Error())
+	}
+	sc, ok := p.subConns[entry]
+	if !ok {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+	return balancer.PickResult{SubConn: sc}, nil
+}
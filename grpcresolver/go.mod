@@ -0,0 +1,12 @@
+module github.com/AppsFlyer/go-consul-resolver/grpcresolver
+
+go 1.15
+
+require (
+	github.com/AppsFlyer/go-consul-resolver v0.0.0-20261018183758-725bf6d791f2
+	github.com/friendsofgo/errors v0.9.2
+	github.com/hashicorp/consul/api v1.8.1
+	github.com/stretchr/testify v1.7.1
+	golang.org/x/net v0.17.0 // indirect
+	google.golang.org/grpc v1.46.2
+)
@@ -0,0 +1,162 @@
+// Package grpcresolver integrates the resolver with gRPC, providing a gRPC resolver.Builder backed by ServiceResolver
+// watches, and a gRPC balancer.Builder delegating the picking of connections to any Balancer.
+package grpcresolver
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	consulresolver "github.com/AppsFlyer/go-consul-resolver"
+	"github.com/friendsofgo/errors"
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+)
+
+// Scheme is the scheme of the targets resolved by the Builder
+const Scheme = "consul"
+
+// Builder builds gRPC resolvers for targets of the form `consul://[authority]/service[?tag=a&tag=b&dc=dc1&fallback=dc2&include_unhealthy=true]`.
+// The authority is ignored, as the resolvers use the Consul client (or Discovery) of the Builder's template.
+type Builder struct {
+	template consulresolver.ResolverConfig
+}
+
+// NewBuilder creates a Builder, which creates a ServiceResolver per target using the given template config.
+// The template's ServiceSpec, Datacenter and FallbackDatacenters are overridden by the target.
+func NewBuilder(template consulresolver.ResolverConfig) *Builder {
+	return &Builder{template: template}
+}
+
+// Register registers a Builder using the given template config as the gRPC resolver of the `consul` scheme
+func Register(template consulresolver.ResolverConfig) {
+	resolver.Register(NewBuilder(template))
+}
+
+// Scheme returns the scheme of the targets resolved by the Builder
+func (b *Builder) Scheme() string {
+	return Scheme
+}
+
+// Build creates a resolver watching the target's service, and pushing its addresses to the client connection
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	conf, err := b.config(target)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := consulresolver.NewConsulResolver(ctx, conf)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	gr := &grpcResolver{resolver: r, cancel: cancel, cc: cc, port: conf.ServiceSpec.ServicePort}
+	gr.unsubscribe = r.Subscribe(gr.update)
+	return gr, nil
+}
+
+// config returns the resolver config of the given target
+func (b *Builder) config(target resolver.Target) (consulresolver.ResolverConfig, error) {
+	conf := b.template
+	service := strings.TrimPrefix(target.URL.Path, "/")
+	if service == "" {
+		service = target.URL.Opaque
+	}
+	if service == "" {
+		return conf, errors.Errorf("target %s does not specify a service", target.URL.String())
+	}
+
+	query := target.URL.Query()
+	conf.ServiceSpec.ServiceName = service
+	conf.ServiceSpec.Tags = query["tag"]
+	if v := query.Get("include_unhealthy"); v != "" {
+		includeUnhealthy, err := strconv.ParseBool(v)
+		if err != nil {
+			return conf, errors.Wrap(err, "invalid include_unhealthy parameter")
+		}
+		conf.ServiceSpec.IncludeUnhealthy = includeUnhealthy
+	}
+	conf.Datacenter = query.Get("dc")
+	conf.FallbackDatacenters = nil
+	for _, fallback := range query["fallback"] {
+		conf.FallbackDatacenters = append(conf.FallbackDatacenters, strings.Split(fallback, ",")...)
+	}
+	// the resolver must not block the creation of the client connection
+	conf.WaitForReady = false
+	return conf, nil
+}
+
+type grpcResolver struct {
+	resolver    *consulresolver.ServiceResolver
+	cancel      context.CancelFunc
+	unsubscribe func()
+	cc          resolver.ClientConn
+	port        int
+}
+
+func (g *grpcResolver) update(event consulresolver.TargetsChangedEvent) {
+	if len(event.Targets) == 0 {
+		g.cc.ReportError(errors.Errorf("no instances found for service %s", event.ServiceName))
+		return
+	}
+
+	addrs := make([]resolver.Address, 0, len(event.Targets))
+	for _, t := range event.Targets {
+		addrs = append(addrs, resolver.Address{
+			Addr:       g.address(t),
+			Attributes: attributes.New(instanceKey{}, Instance{Entry: t, Datacenter: event.Datacenter}),
+		})
+	}
+	_ = g.cc.UpdateState(resolver.State{Addresses: addrs})
+}
+
+// address returns the host:port of the given target
+func (g *grpcResolver) address(t *api.ServiceEntry) string {
+	host := t.Service.Address
+	if host == "" {
+		host = t.Node.Address
+	}
+	port := t.Service.Port
+	if g.port > 0 {
+		port = g.port
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// ResolveNow is a no-op, as the addresses are pushed whenever they change
+func (g *grpcResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (g *grpcResolver) Close() {
+	g.unsubscribe()
+	_ = g.resolver.Close()
+	g.cancel()
+}
+
+type instanceKey struct{}
+
+// Instance is the instance backing a gRPC address, which holds its tags, meta and weights
+type Instance struct {
+	Entry *api.ServiceEntry
+	// The datacenter of the instance, or an empty string for the local datacenter
+	Datacenter string
+}
+
+// Equal reports whether the given instance has the same details, so that gRPC keeps the connections of unchanged instances
+func (i Instance) Equal(o interface{}) bool {
+	other, ok := o.(Instance)
+	if !ok {
+		return false
+	}
+	return i.Datacenter == other.Datacenter &&
+		consulresolver.InstancesIndex([]*api.ServiceEntry{i.Entry}) == consulresolver.InstancesIndex([]*api.ServiceEntry{other.Entry})
+}
+
+// InstanceFromAddress returns the instance backing an address provided by the resolver
+func InstanceFromAddress(addr resolver.Address) (Instance, bool) {
+	instance, ok := addr.Attributes.Value(instanceKey{}).(Instance)
+	return instance, ok
+}
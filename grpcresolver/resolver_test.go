@@ -0,0 +1,125 @@
+package grpcresolver
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	consulresolver "github.com/AppsFlyer/go-consul-resolver"
+	"github.com/AppsFlyer/go-consul-resolver/lb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/resolver"
+)
+
+const testBalancerName = "test_weighted_round_robin"
+
+func init() {
+	RegisterBalancer(testBalancerName, func() consulresolver.Balancer {
+		return &lb.WeightedRoundRobinLoadBalancer{}
+	})
+}
+
+func startGRPCServer(t *testing.T) consulresolver.StaticInstance {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(srv.Stop)
+
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+	p, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	return consulresolver.StaticInstance{Address: host, Port: p}
+}
+
+func TestResolverAndBalancer(t *testing.T) {
+	heavy := startGRPCServer(t)
+	heavy.Weight = 3
+	heavy.Tags = []string{"grpc"}
+	light := startGRPCServer(t)
+	light.Weight = 1
+	light.Tags = []string{"grpc"}
+	other := startGRPCServer(t)
+
+	builder := NewBuilder(consulresolver.ResolverConfig{
+		Discovery: &consulresolver.StaticDiscovery{Services: consulresolver.StaticServices{"orders": {heavy, light, other}}},
+	})
+
+	conn, err := grpc.Dial("consul:///orders?tag=grpc",
+		grpc.WithInsecure(),
+		grpc.WithResolvers(builder),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"`+testBalancerName+`": {}}]}`),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+	check := func() string {
+		var p peer.Peer
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Peer(&p), grpc.WaitForReady(true))
+		require.NoError(t, err)
+		return p.Addr.String()
+	}
+
+	heavyAddr := net.JoinHostPort(heavy.Address, strconv.Itoa(heavy.Port))
+	lightAddr := net.JoinHostPort(light.Address, strconv.Itoa(light.Port))
+
+	// wait for both connections to become ready
+	assert.Eventually(t, func() bool {
+		seen := map[string]bool{}
+		for i := 0; i < 8; i++ {
+			seen[check()] = true
+		}
+		return seen[heavyAddr] && seen[lightAddr]
+	}, 5*time.Second, 10*time.Millisecond)
+
+	hits := map[string]int{}
+	for i := 0; i < 40; i++ {
+		hits[check()]++
+	}
+	assert.Equal(t, map[string]int{heavyAddr: 30, lightAddr: 10}, hits)
+}
+
+func TestBuilderConfig(t *testing.T) {
+	b := NewBuilder(consulresolver.ResolverConfig{Datacenter: "ignored", FallbackDatacenters: []string{"ignored"}})
+
+	u, err := url.Parse("consul://agent:8500/orders?tag=a&tag=b&dc=dc1&fallback=dc2,dc3&fallback=dc4&include_unhealthy=true")
+	require.NoError(t, err)
+	conf, err := b.config(resolver.Target{URL: *u})
+	require.NoError(t, err)
+
+	assert.Equal(t, "orders", conf.ServiceSpec.ServiceName)
+	assert.Equal(t, []string{"a", "b"}, conf.ServiceSpec.Tags)
+	assert.True(t, conf.ServiceSpec.IncludeUnhealthy)
+	assert.Equal(t, "dc1", conf.Datacenter)
+	assert.Equal(t, []string{"dc2", "dc3", "dc4"}, conf.FallbackDatacenters)
+
+	u, err = url.Parse("consul:///")
+	require.NoError(t, err)
+	_, err = b.config(resolver.Target{URL: *u})
+	assert.Error(t, err)
+}
+
+func TestInstanceEqual(t *testing.T) {
+	instance := consulresolver.StaticInstance{Address: "10.0.0.1", Port: 8080, Tags: []string{"a"}}
+	discovery := &consulresolver.StaticDiscovery{Services: consulresolver.StaticServices{"orders": {instance, instance}}}
+	res, err := discovery.Watch(context.Background(), consulresolver.DiscoveryRequest{ServiceName: "orders"})
+	require.NoError(t, err)
+
+	// equal details are equal, regardless of identity
+	assert.True(t, Instance{Entry: res.Instances[0]}.Equal(Instance{Entry: res.Instances[1]}))
+	assert.False(t, Instance{Entry: res.Instances[0], Datacenter: "dc1"}.Equal(Instance{Entry: res.Instances[1]}))
+}
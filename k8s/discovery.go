@@ -0,0 +1,195 @@
+// Package k8s provides a discovery source watching the Kubernetes EndpointSlices of services, allowing
+// the resolver, its balancers and the LoadBalancedTransport to be used with services running in Kubernetes.
+package k8s
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	consulresolver "github.com/AppsFlyer/go-consul-resolver"
+	"github.com/friendsofgo/errors"
+	"github.com/hashicorp/consul/api"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+const (
+	// ZoneMetaKey is the meta key holding the zone of an endpoint
+	ZoneMetaKey = "zone"
+	// PodMetaKey is the meta key holding the name of the pod backing an endpoint
+	PodMetaKey = "pod"
+	// NamespaceMetaKey is the meta key holding the namespace of an endpoint
+	NamespaceMetaKey = "namespace"
+
+	defaultNamespace = "default"
+)
+
+// Informer provides the EndpointSlices of services, and notifies of changes to them
+type Informer interface {
+	// List returns the EndpointSlices of the given service
+	List(namespace, service string) ([]*discoveryv1.EndpointSlice, error)
+	// OnChange registers a function to be called whenever an EndpointSlice is added, updated or deleted
+	OnChange(fn func())
+}
+
+type Config struct {
+	// The informer providing the EndpointSlices
+	// Mandatory
+	Informer Informer
+	// The namespace of the services
+	// Optional
+	// Default: "default"
+	Namespace string
+	// The name of the port to use, for services exposing multiple ports
+	// Optional
+	// Default: the first port of every EndpointSlice
+	PortName string
+}
+
+// Discovery discovers the instances of services from their Kubernetes EndpointSlices.
+// Every endpoint is mapped to a ServiceEntry whose node is the endpoint's node, and whose meta holds its zone, pod and namespace.
+// Only ready endpoints are returned, unless unhealthy instances are requested.
+// The requested datacenter is treated as a zone, so that zones may be used as failover tiers using FallbackDatacenters.
+// An empty datacenter matches all the zones.
+type Discovery struct {
+	informer  Informer
+	namespace string
+	portName  string
+
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced on every change
+}
+
+// New creates a new Discovery
+func New(conf Config) (*Discovery, error) {
+	if conf.Informer == nil {
+		return nil, errors.New("informer must not be nil")
+	}
+	if conf.Namespace == "" {
+		conf.Namespace = defaultNamespace
+	}
+
+	d := &Discovery{
+		informer:  conf.Informer,
+		namespace: conf.Namespace,
+		portName:  conf.PortName,
+		changed:   make(chan struct{}),
+	}
+	conf.Informer.OnChange(d.notify)
+	return d, nil
+}
+
+// Watch returns the endpoints of the requested service. If the request has a WaitIndex, Watch blocks until they change.
+func (d *Discovery) Watch(ctx context.Context, req consulresolver.DiscoveryRequest) (*consulresolver.DiscoveryResult, error) {
+	for {
+		// obtain the change notification before listing, so that no change is missed
+		changed := d.changes()
+
+		slices, err := d.informer.List(d.namespace, req.ServiceName)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed listing endpoint slices")
+		}
+
+		instances := d.instances(slices, req)
+		index := consulresolver.InstancesIndex(instances)
+		if index != req.WaitIndex {
+			return &consulresolver.DiscoveryResult{Instances: instances, Index: index}, nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (d *Discovery) instances(slices []*discoveryv1.EndpointSlice, req consulresolver.DiscoveryRequest) []*api.ServiceEntry {
+	instances := []*api.ServiceEntry{}
+	seen := map[string]struct{}{}
+	for _, slice := range slices {
+		port, ok := d.port(slice)
+		if !ok {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if len(endpoint.Addresses) == 0 {
+				continue
+			}
+			// a nil readiness should be interpreted as ready
+			if !req.IncludeUnhealthy && endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			zone := ""
+			if endpoint.Zone != nil {
+				zone = *endpoint.Zone
+			}
+			if req.Datacenter != "" && zone != req.Datacenter {
+				continue
+			}
+
+			address := endpoint.Addresses[0]
+			id := net.JoinHostPort(address, strconv.Itoa(port))
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+
+			meta := map[string]string{NamespaceMetaKey: slice.Namespace}
+			if zone != "" {
+				meta[ZoneMetaKey] = zone
+			}
+			if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" {
+				meta[PodMetaKey] = endpoint.TargetRef.Name
+			}
+			node := address
+			if endpoint.NodeName != nil && *endpoint.NodeName != "" {
+				node = *endpoint.NodeName
+			}
+
+			instances = append(instances, &api.ServiceEntry{
+				Node: &api.Node{Node: node, Address: address, Datacenter: zone},
+				Service: &api.AgentService{
+					ID:      id,
+					Service: req.ServiceName,
+					Address: address,
+					Port:    port,
+					Meta:    meta,
+				},
+				Checks: api.HealthChecks{},
+			})
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Service.ID < instances[j].Service.ID
+	})
+	return instances
+}
+
+// port returns the port of the slice to use
+func (d *Discovery) port(slice *discoveryv1.EndpointSlice) (int, bool) {
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		if d.portName == "" || (p.Name != nil && *p.Name == d.portName) {
+			return int(*p.Port), true
+		}
+	}
+	return 0, false
+}
+
+func (d *Discovery) changes() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.changed
+}
+
+func (d *Discovery) notify() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
@@ -0,0 +1,111 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	consulresolver "github.com/AppsFlyer/go-consul-resolver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newEndpointSlice(name, service string, port int32, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	portName := "http"
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+	}
+}
+
+func newEndpoint(address, zone string, ready bool) discoveryv1.Endpoint {
+	node := "node-" + address
+	return discoveryv1.Endpoint{
+		Addresses:  []string{address},
+		Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		Zone:       &zone,
+		NodeName:   &node,
+		TargetRef:  &corev1.ObjectReference{Kind: "Pod", Name: "pod-" + address},
+	}
+}
+
+func newTestDiscovery(t *testing.T, objects ...*discoveryv1.EndpointSlice) (*Discovery, *fake.Clientset) {
+	clientset := fake.NewSimpleClientset()
+	for _, o := range objects {
+		_, err := clientset.DiscoveryV1().EndpointSlices(o.Namespace).Create(context.Background(), o, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	informer, err := NewClientsetInformer(ctx, clientset, "", 0)
+	require.NoError(t, err)
+
+	d, err := New(Config{Informer: informer})
+	require.NoError(t, err)
+	return d, clientset
+}
+
+func TestDiscoveryMapsReadyEndpoints(t *testing.T) {
+	d, _ := newTestDiscovery(t,
+		newEndpointSlice("orders-1", "orders", 8080,
+			newEndpoint("10.0.0.1", "us-east-1a", true),
+			newEndpoint("10.0.0.2", "us-east-1b", false),
+		),
+		newEndpointSlice("orders-2", "orders", 8080, newEndpoint("10.0.0.3", "us-east-1b", true)),
+		newEndpointSlice("payments-1", "payments", 9090, newEndpoint("10.0.1.1", "us-east-1a", true)),
+	)
+
+	res, err := d.Watch(context.Background(), consulresolver.DiscoveryRequest{ServiceName: "orders"})
+	require.NoError(t, err)
+	require.Len(t, res.Instances, 2)
+
+	first := res.Instances[0]
+	assert.Equal(t, "10.0.0.1", first.Service.Address)
+	assert.Equal(t, 8080, first.Service.Port)
+	assert.Equal(t, "node-10.0.0.1", first.Node.Node)
+	assert.Equal(t, map[string]string{ZoneMetaKey: "us-east-1a", PodMetaKey: "pod-10.0.0.1", NamespaceMetaKey: "default"}, first.Service.Meta)
+	assert.Equal(t, "10.0.0.3", res.Instances[1].Service.Address)
+
+	// the datacenter selects a zone
+	res, err = d.Watch(context.Background(), consulresolver.DiscoveryRequest{ServiceName: "orders", Datacenter: "us-east-1b", IncludeUnhealthy: true})
+	require.NoError(t, err)
+	require.Len(t, res.Instances, 2)
+	assert.Equal(t, "10.0.0.2", res.Instances[0].Service.Address)
+	assert.Equal(t, "10.0.0.3", res.Instances[1].Service.Address)
+}
+
+func TestResolverWithKubernetesDiscovery(t *testing.T) {
+	d, clientset := newTestDiscovery(t, newEndpointSlice("orders-1", "orders", 8080, newEndpoint("10.0.0.1", "us-east-1a", true)))
+
+	r, err := consulresolver.NewConsulResolver(context.Background(), consulresolver.ResolverConfig{
+		ServiceSpec:  consulresolver.ServiceSpec{ServiceName: "orders"},
+		Discovery:    d,
+		WaitForReady: true,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	addr, err := r.Resolve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, consulresolver.ServiceAddress{Host: "10.0.0.1", Port: 8080}, addr)
+
+	updated := newEndpointSlice("orders-1", "orders", 8080, newEndpoint("10.0.0.2", "us-east-1a", true))
+	_, err = clientset.DiscoveryV1().EndpointSlices("default").Update(context.Background(), updated, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		addr, err := r.Resolve(context.Background())
+		return err == nil && addr == consulresolver.ServiceAddress{Host: "10.0.0.2", Port: 8080}
+	}, 3*time.Second, 10*time.Millisecond)
+}
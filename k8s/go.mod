@@ -0,0 +1,15 @@
+module github.com/AppsFlyer/go-consul-resolver/k8s
+
+go 1.16
+
+require (
+	github.com/AppsFlyer/go-consul-resolver v0.0.0-20261018183758-725bf6d791f2
+	github.com/friendsofgo/errors v0.9.2
+	github.com/hashicorp/consul/api v1.8.1
+	github.com/stretchr/testify v1.7.1
+	golang.org/x/net v0.17.0 // indirect
+	k8s.io/api v0.21.14
+	k8s.io/apimachinery v0.21.14
+	k8s.io/client-go v0.21.14
+	k8s.io/klog/v2 v2.60.1 // indirect
+)
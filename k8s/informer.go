@@ -0,0 +1,55 @@
+package k8s
+
+import (
+	"context"
+	"time"
+
+	"github.com/friendsofgo/errors"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	discoveryinformers "k8s.io/client-go/informers/discovery/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// sharedInformer adapts a client-go EndpointSlice informer to the Informer interface
+type sharedInformer struct {
+	informer discoveryinformers.EndpointSliceInformer
+}
+
+// NewInformer adapts an EndpointSlice informer created by a client-go informer factory.
+// The factory must be started, and its cache synced, by the caller.
+func NewInformer(informer discoveryinformers.EndpointSliceInformer) Informer {
+	return &sharedInformer{informer: informer}
+}
+
+// NewClientsetInformer creates an informer watching the EndpointSlices of the given namespace (or all namespaces if empty)
+// using the given clientset, and blocks until its cache is synced. The informer is stopped once the context is done.
+func NewClientsetInformer(ctx context.Context, clientset kubernetes.Interface, namespace string, resync time.Duration) (Informer, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, resync, informers.WithNamespace(namespace))
+	informer := factory.Discovery().V1().EndpointSlices()
+	// the informer must be requested before the factory is started, for it to be started
+	informer.Informer()
+	factory.Start(ctx.Done())
+
+	for _, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return nil, errors.New("failed syncing endpoint slices informer")
+		}
+	}
+	return NewInformer(informer), nil
+}
+
+func (s *sharedInformer) List(namespace, service string) ([]*discoveryv1.EndpointSlice, error) {
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: service})
+	return s.informer.Lister().EndpointSlices(namespace).List(selector)
+}
+
+func (s *sharedInformer) OnChange(fn func()) {
+	s.informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { fn() },
+		UpdateFunc: func(interface{}, interface{}) { fn() },
+		DeleteFunc: func(interface{}) { fn() },
+	})
+}
@@ -0,0 +1,267 @@
+package consulresolver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/friendsofgo/errors"
+)
+
+const (
+	defaultLazyIdleTTL        = 10 * time.Minute
+	defaultLazyFailureBackoff = 5 * time.Second
+	defaultLazyCreateTimeout  = 10 * time.Second
+)
+
+// lazyResolvers creates resolvers on demand for hosts matched by a HostMatcher, and evicts them once they are idle
+type lazyResolvers struct {
+	conf      LazyResolverConfig
+	logger    Logger
+	mu        sync.RWMutex
+	resolvers map[resolverKey]*lazyResolver
+	// creations holds the resolvers being created, and the failed creations during their backoff
+	creations map[resolverKey]*lazyCreation
+	closed    bool
+}
+
+// lazyCreation is shared by the concurrent lookups of a resolver being created
+type lazyCreation struct {
+	done chan struct{}
+}
+
+type lazyResolver struct {
+	resolver *ServiceResolver
+	// lastUsed holds the time of the last lookup, in unix nanoseconds
+	lastUsed int64
+	timer    *time.Timer
+}
+
+func newLazyResolvers(conf *LazyResolverConfig, logger Logger) (*lazyResolvers, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	if conf.Template.Client == nil && conf.Template.Discovery == nil {
+		return nil, errors.New("lazy resolver template must have a consul client or a discovery")
+	}
+
+	if conf.Template.Balancer != nil {
+		return nil, errors.New("lazy resolver template must not have a balancer, use NewBalancer instead")
+	}
+
+	if conf.Template.SnapshotStore != nil {
+		return nil, errors.New("lazy resolver template must not have a snapshot store, as it cannot be shared between resolvers")
+	}
+
+	if conf.Template.WaitForReady {
+		return nil, errors.New("lazy resolver template must not wait for readiness, as resolvers are created while handling requests")
+	}
+
+	if conf.Template.Log == nil && conf.Template.Logger == nil {
+		conf.Template.Logger = logger
+	}
+
+	if conf.IdleTTL <= 0 {
+		conf.IdleTTL = defaultLazyIdleTTL
+	}
+
+	if conf.FailureBackoff <= 0 {
+		conf.FailureBackoff = defaultLazyFailureBackoff
+	}
+
+	if conf.CreateTimeout <= 0 {
+		conf.CreateTimeout = defaultLazyCreateTimeout
+	}
+
+	return &lazyResolvers{
+		conf:      *conf,
+		logger:    withComponent(logger, componentLazy),
+		resolvers: map[resolverKey]*lazyResolver{},
+		creations: map[resolverKey]*lazyCreation{},
+	}, nil
+}
+
+// get returns the resolver for the given match, creating it if needed, and waiting for its creation until ctx is done.
+// Concurrent lookups of the same match share a single creation, and a failed creation is not retried until its
+// backoff elapses.
+func (l *lazyResolvers) get(ctx context.Context, match HostMatch) (Resolver, bool) {
+	key := resolverKey{service: match.ServiceName, datacenter: match.Datacenter}
+
+	l.mu.RLock()
+	lr, ok := l.resolvers[key]
+	if ok {
+		atomic.StoreInt64(&lr.lastUsed, time.Now().UnixNano())
+	}
+	l.mu.RUnlock()
+	if ok {
+		return lr.resolver, true
+	}
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, false
+	}
+	if lr, ok := l.resolvers[key]; ok {
+		atomic.StoreInt64(&lr.lastUsed, time.Now().UnixNano())
+		l.mu.Unlock()
+		return lr.resolver, true
+	}
+	c, ok := l.creations[key]
+	if !ok {
+		c = &lazyCreation{done: make(chan struct{})}
+		l.creations[key] = c
+		// create the resolver in the background, so that it is not abandoned when the context of the lookup is done
+		go l.create(key, match, c)
+	}
+	l.mu.Unlock()
+
+	// wait for the creation in progress, or fail immediately during the backoff of a failed one
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return nil, false
+	}
+	l.mu.RLock()
+	lr, ok = l.resolvers[key]
+	if ok {
+		atomic.StoreInt64(&lr.lastUsed, time.Now().UnixNano())
+	}
+	l.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return lr.resolver, true
+}
+
+// create creates the resolver of the given creation, and registers it
+func (l *lazyResolvers) create(key resolverKey, match HostMatch, c *lazyCreation) {
+	created, err := l.newResolver(match)
+	if err != nil {
+		l.logger.Log(LevelError, "failed creating resolver", serviceField(match.ServiceName), datacenterField(match.Datacenter), errorField(err))
+		// keep the failed creation until the backoff elapses, failing the lookups in the meantime
+		close(c.done)
+		time.AfterFunc(l.conf.FailureBackoff, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.creations[key] == c {
+				delete(l.creations, key)
+			}
+		})
+		return
+	}
+
+	l.mu.Lock()
+	delete(l.creations, key)
+	if l.closed {
+		l.mu.Unlock()
+		close(c.done)
+		_ = created.resolver.Close()
+		return
+	}
+	l.resolvers[key] = created
+	created.timer = time.AfterFunc(l.conf.IdleTTL, func() { l.evict(key, created) })
+	l.mu.Unlock()
+	close(c.done)
+}
+
+func (l *lazyResolvers) newResolver(match HostMatch) (*lazyResolver, error) {
+	conf := l.conf.Template
+	conf.ServiceSpec.ServiceName = match.ServiceName
+	if match.Datacenter != "" {
+		conf.Datacenter = match.Datacenter
+	}
+	if l.conf.NewBalancer != nil {
+		conf.Balancer = l.conf.NewBalancer(match)
+	}
+
+	// the creation may query the consul agent, so the resolver's context is canceled if it takes too long
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(l.conf.CreateTimeout, cancel)
+	r, err := NewConsulResolver(ctx, conf)
+	if !timer.Stop() {
+		if err == nil {
+			_ = r.Close()
+		}
+		return nil, errors.Errorf("timed out creating resolver after %s", l.conf.CreateTimeout)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &lazyResolver{resolver: r, lastUsed: time.Now().UnixNano()}, nil
+}
+
+// evict stops the resolver if it was idle for the entire TTL, or reschedules the check otherwise
+func (l *lazyResolvers) evict(key resolverKey, lr *lazyResolver) {
+	l.mu.Lock()
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&lr.lastUsed)))
+	if idle < l.conf.IdleTTL {
+		lr.timer.Reset(l.conf.IdleTTL - idle)
+		l.mu.Unlock()
+		return
+	}
+
+	if l.resolvers[key] == lr {
+		delete(l.resolvers, key)
+	}
+	l.mu.Unlock()
+
+	// close the resolver outside of the lock, as it waits for its consul-watcher go routines to exit
+	_ = lr.resolver.Close()
+	l.logger.Log(LevelInfo, "evicted idle resolver", serviceField(key.service), datacenterField(key.datacenter))
+}
+
+// remove stops and evicts the given resolver, returning false if it was not created by lazyResolvers
+func (l *lazyResolvers) remove(r Resolver) bool {
+	sr, ok := r.(*ServiceResolver)
+	if !ok {
+		return false
+	}
+
+	l.mu.Lock()
+	var removed *lazyResolver
+	for key, lr := range l.resolvers {
+		if lr.resolver == sr {
+			delete(l.resolvers, key)
+			lr.timer.Stop()
+			removed = lr
+			break
+		}
+	}
+	l.mu.Unlock()
+
+	if removed == nil {
+		return false
+	}
+	_ = removed.resolver.Close()
+	return true
+}
+
+// close stops all the created resolvers, and prevents new ones from being created
+func (l *lazyResolvers) close() {
+	l.mu.Lock()
+	resolvers := l.resolvers
+	l.resolvers = map[resolverKey]*lazyResolver{}
+	l.closed = true
+	l.mu.Unlock()
+
+	for _, lr := range resolvers {
+		lr.timer.Stop()
+		_ = lr.resolver.Close()
+	}
+}
+
+func (l *lazyResolvers) list() []Resolver {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	res := make([]Resolver, 0, len(l.resolvers))
+	for _, lr := range l.resolvers {
+		res = append(res, lr.resolver)
+	}
+	return res
+}
@@ -0,0 +1,143 @@
+package consulresolver
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLazyResolversCreateOnDemand(t *testing.T) {
+	client, fake := newFakeConsulClient(t)
+
+	registry := newTestLazyRegistry(t, client, time.Minute)
+
+	r, ok := registry.lookup(context.Background(), "orders.service.dc2.consul:8080")
+	require.True(t, ok)
+	assert.Equal(t, "orders", r.ServiceName())
+	assert.Equal(t, "dc2", r.(DatacenterResolver).Datacenter())
+
+	again, ok := registry.lookup(context.Background(), "orders.service.dc2.consul")
+	require.True(t, ok)
+	assert.Same(t, r, again)
+
+	_, ok = registry.lookup(context.Background(), "google.com")
+	assert.False(t, ok)
+
+	assert.Eventually(t, func() bool { return fake.queriesFor("orders@dc2") > 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestLazyResolversEvictIdle(t *testing.T) {
+	client, _ := newFakeConsulClient(t)
+
+	registry := newTestLazyRegistry(t, client, 50*time.Millisecond)
+
+	r, ok := registry.lookup(context.Background(), "orders.service.consul")
+	require.True(t, ok)
+
+	assert.Eventually(t, func() bool {
+		registry.lazy.mu.RLock()
+		defer registry.lazy.mu.RUnlock()
+		return len(registry.lazy.resolvers) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// the evicted resolver is stopped, and a new one is created on the next lookup
+	assert.Error(t, r.(*ServiceResolver).ctx.Err())
+	created, ok := registry.lookup(context.Background(), "orders.service.consul")
+	require.True(t, ok)
+	assert.NotSame(t, r, created)
+}
+
+func TestLazyResolversFailedCreation(t *testing.T) {
+	client, fake := newFakeConsulClient(t)
+	fake.agentDown = true
+
+	// resolvers with fallback datacenters fail to be created when the local datacenter cannot be determined
+	lazy, err := newLazyResolvers(&LazyResolverConfig{
+		Template:       ResolverConfig{Client: client, FallbackDatacenters: []string{"dc2"}},
+		FailureBackoff: 200 * time.Millisecond,
+	}, newLogger(nil, nil))
+	require.NoError(t, err)
+	registry := newResolverRegistry(nil, nil, []HostMatcher{ConsulDomainMatcher{}}, lazy)
+	defer registry.close()
+
+	// concurrent lookups share a single creation, and lookups during the backoff fail without retrying it
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ok := registry.lookup(context.Background(), "orders.service.consul")
+			assert.False(t, ok)
+		}()
+	}
+	wg.Wait()
+	_, ok := registry.lookup(context.Background(), "orders.service.consul")
+	assert.False(t, ok)
+	assert.Equal(t, 1, fake.queriesFor("agent/self"))
+
+	// once the backoff elapses, the creation is retried
+	fake.mu.Lock()
+	fake.agentDown = false
+	fake.mu.Unlock()
+	assert.Eventually(t, func() bool {
+		_, ok := registry.lookup(context.Background(), "orders.service.consul")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestLazyResolversBoundedCreation(t *testing.T) {
+	client, fake := newFakeConsulClient(t)
+	fake.agentHangs = true
+
+	_, err := newLazyResolvers(&LazyResolverConfig{Template: ResolverConfig{Client: client, WaitForReady: true}}, newLogger(nil, nil))
+	assert.Error(t, err)
+
+	lazy, err := newLazyResolvers(&LazyResolverConfig{
+		Template:      ResolverConfig{Client: client, FallbackDatacenters: []string{"dc2"}},
+		CreateTimeout: 300 * time.Millisecond,
+	}, newLogger(nil, nil))
+	require.NoError(t, err)
+	registry := newResolverRegistry(nil, nil, []HostMatcher{ConsulDomainMatcher{}}, lazy)
+	defer registry.close()
+
+	// a lookup waits for the creation only until its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, ok := registry.lookup(ctx, "orders.service.consul")
+	assert.False(t, ok)
+	assert.Less(t, int64(time.Since(start)), int64(250*time.Millisecond))
+
+	// the creation fails once its timeout elapses, even though the agent never responds
+	start = time.Now()
+	_, ok = registry.lookup(context.Background(), "orders.service.consul")
+	assert.False(t, ok)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Equal(t, 1, fake.queriesFor("agent/self"))
+}
+
+func newTestLazyRegistry(t *testing.T, client *api.Client, ttl time.Duration) *resolverRegistry {
+	lazy, err := newLazyResolvers(&LazyResolverConfig{
+		Template: ResolverConfig{Client: client},
+		IdleTTL:  ttl,
+	}, newLogger(nil, nil))
+	require.NoError(t, err)
+	registry := newResolverRegistry(nil, nil, []HostMatcher{ConsulDomainMatcher{}}, lazy)
+	t.Cleanup(registry.close)
+	return registry
+}
+
+func TestLazyResolversRejectSharedSnapshotStore(t *testing.T) {
+	client, _ := newFakeConsulClient(t)
+
+	_, err := newLazyResolvers(&LazyResolverConfig{
+		Template: ResolverConfig{Client: client, SnapshotStore: FileSnapshotStore{Path: filepath.Join(t.TempDir(), "snapshot.json")}},
+	}, newLogger(nil, nil))
+	assert.Error(t, err)
+}
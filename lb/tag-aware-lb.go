@@ -58,3 +58,18 @@ func (t *TagAwareLoadBalancer) UpdateTargets(targets []*api.ServiceEntry) {
 	}
 	t.tagsMapping = newMapping
 }
+
+// DebugState returns the number of targets matching each of the preferred tags
+func (t *TagAwareLoadBalancer) DebugState() interface{} {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	counts := make(map[string]int, len(t.tagsMapping))
+	for tag, targets := range t.tagsMapping {
+		counts[tag] = len(targets)
+	}
+	return map[string]interface{}{
+		"targets":          len(t.targets),
+		"tagged_targets":   counts,
+		"fallback_allowed": t.FallbackAllowed,
+	}
+}
@@ -0,0 +1,75 @@
+package lb
+
+import (
+	"sync"
+
+	"github.com/friendsofgo/errors"
+	"github.com/hashicorp/consul/api"
+)
+
+// WeightedRoundRobinLoadBalancer selects targets in proportion to their `Service.Weights.Passing`,
+// using a smooth weighted round robin which interleaves the selections of the targets.
+// Targets without a positive weight are given a weight of 1.
+type WeightedRoundRobinLoadBalancer struct {
+	targets []*api.ServiceEntry
+	weights []int
+	current []int
+	total   int
+	mu      sync.Mutex
+}
+
+func (w *WeightedRoundRobinLoadBalancer) Select() (*api.ServiceEntry, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.targets) == 0 {
+		return nil, errors.New("unable to select target from empty list")
+	}
+
+	best := 0
+	for i := range w.targets {
+		w.current[i] += w.weights[i]
+		if w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	w.current[best] -= w.total
+	return w.targets[best], nil
+}
+
+func (w *WeightedRoundRobinLoadBalancer) UpdateTargets(targets []*api.ServiceEntry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.targets = targets
+	w.weights = make([]int, len(targets))
+	w.current = make([]int, len(targets))
+	w.total = 0
+	for i, target := range targets {
+		weight := 1
+		if target.Service != nil && target.Service.Weights.Passing > 0 {
+			weight = target.Service.Weights.Passing
+		}
+		w.weights[i] = weight
+		w.total += weight
+	}
+}
+
+// WeightedTargetState describes the state of a single target of a WeightedRoundRobinLoadBalancer
+type WeightedTargetState struct {
+	ID      string `json:"id"`
+	Weight  int    `json:"weight"`
+	Current int    `json:"current"`
+}
+
+// DebugState returns the effective weight and the current smooth weighted round robin score of every target
+func (w *WeightedRoundRobinLoadBalancer) DebugState() interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	state := make([]WeightedTargetState, len(w.targets))
+	for i, target := range w.targets {
+		state[i] = WeightedTargetState{Weight: w.weights[i], Current: w.current[i]}
+		if target.Service != nil {
+			state[i].ID = target.Service.ID
+		}
+	}
+	return state
+}
@@ -0,0 +1,43 @@
+package lb
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeightedRoundRobinLoadBalancer(t *testing.T) {
+	lb := &WeightedRoundRobinLoadBalancer{}
+	lb.UpdateTargets([]*api.ServiceEntry{
+		{Service: &api.AgentService{ID: "1", Weights: api.AgentWeights{Passing: 5}}},
+		{Service: &api.AgentService{ID: "2", Weights: api.AgentWeights{Passing: 1}}},
+		{Service: &api.AgentService{ID: "3"}},
+	})
+
+	var selected []string
+	for i := 0; i < 7; i++ {
+		res, err := lb.Select()
+		assert.NoError(t, err)
+		selected = append(selected, res.Service.ID)
+	}
+	assert.Equal(t, []string{"1", "1", "2", "1", "3", "1", "1"}, selected)
+}
+
+func TestWeightedRoundRobinLoadBalancerEmpty(t *testing.T) {
+	lb := &WeightedRoundRobinLoadBalancer{}
+	_, err := lb.Select()
+	assert.Error(t, err)
+}
+
+func TestWeightedRoundRobinLoadBalancerDebugState(t *testing.T) {
+	lb := &WeightedRoundRobinLoadBalancer{}
+	lb.UpdateTargets([]*api.ServiceEntry{
+		{Service: &api.AgentService{ID: "1", Weights: api.AgentWeights{Passing: 3}}},
+		{Service: &api.AgentService{ID: "2"}},
+	})
+	_, err := lb.Select()
+	assert.NoError(t, err)
+
+	assert.Equal(t, []WeightedTargetState{{ID: "1", Weight: 3, Current: -1}, {ID: "2", Weight: 1, Current: 1}}, lb.DebugState())
+}
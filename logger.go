@@ -0,0 +1,166 @@
+package consulresolver
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Level is the severity of a log message
+type Level int
+
+const (
+	// LevelDebug is used for frequent messages that are only useful for troubleshooting, e.g. requests to unknown hosts
+	LevelDebug Level = iota
+	// LevelInfo is used for notable events, e.g. seeding a resolver from a snapshot or evicting an idle resolver
+	LevelInfo
+	// LevelWarn is used for recoverable failures, e.g. a failed discovery query that is retried
+	LevelWarn
+	// LevelError is used for failures that are not retried
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+	}
+}
+
+// The keys of the fields attached to log messages
+const (
+	FieldService    = "service"
+	FieldDatacenter = "datacenter"
+	FieldHost       = "host"
+	FieldAttempt    = "attempt"
+	FieldBackoff    = "backoff"
+	FieldError      = "error"
+	// FieldComponent holds the component logging the message, e.g. "Consul Resolver" or "LoadBalancedTransport"
+	FieldComponent = "component"
+)
+
+// The components attached to log messages
+const (
+	componentResolver  = "Consul Resolver"
+	componentLazy      = "Lazy Resolvers"
+	componentTransport = "LoadBalancedTransport"
+	componentDialer    = "LoadBalancedDialer"
+)
+
+// Field is a key-value pair attached to a log message
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger is a leveled, structured logger. Implementations must be safe for concurrent use.
+// The slogadapter package provides an implementation backed by log/slog.
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// LogFnLogger is a Logger writing the messages of at least MinLevel to a printf-style LogFn,
+// formatting the fields as key=value pairs following the message.
+// The component field is written as a `[component]` prefix of the message, as printed by earlier versions.
+type LogFnLogger struct {
+	// The function the messages are written to
+	// Mandatory
+	Fn LogFn
+	// The minimal level of the written messages
+	// Optional
+	// Default: LevelDebug (all messages are written)
+	MinLevel Level
+}
+
+func (l LogFnLogger) Log(level Level, msg string, fields ...Field) {
+	if level < l.MinLevel {
+		return
+	}
+
+	var b strings.Builder
+	for _, f := range fields {
+		if f.Key == FieldComponent {
+			b.WriteString("[" + fmt.Sprint(f.Value) + "] ")
+		}
+	}
+	b.WriteString(msg)
+	for _, f := range fields {
+		if f.Key == FieldComponent {
+			continue
+		}
+		b.WriteByte(' ')
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		b.WriteString(formatFieldValue(f.Value))
+	}
+	l.Fn("%s", b.String())
+}
+
+func formatFieldValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case error:
+		s = v.Error()
+	case time.Duration:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// newLogger returns the configured logger, or a logger writing messages of LevelInfo and above to the configured LogFn
+// (log.Printf by default)
+func newLogger(logger Logger, logFn LogFn) Logger {
+	if logger != nil {
+		return logger
+	}
+	if logFn == nil {
+		logFn = log.Printf
+	}
+	return LogFnLogger{Fn: logFn, MinLevel: LevelInfo}
+}
+
+// componentLogger attaches the component field to the messages of a Logger
+type componentLogger struct {
+	Logger
+	component Field
+}
+
+// withComponent returns a logger attaching the given component to its messages, replacing any component attached
+// by the given logger
+func withComponent(logger Logger, component string) Logger {
+	if l, ok := logger.(componentLogger); ok {
+		logger = l.Logger
+	}
+	return componentLogger{Logger: logger, component: Field{Key: FieldComponent, Value: component}}
+}
+
+func (l componentLogger) Log(level Level, msg string, fields ...Field) {
+	l.Logger.Log(level, msg, append([]Field{l.component}, fields...)...)
+}
+
+func serviceField(service string) Field {
+	return Field{Key: FieldService, Value: service}
+}
+
+func datacenterField(datacenter string) Field {
+	return Field{Key: FieldDatacenter, Value: datacenter}
+}
+
+func errorField(err error) Field {
+	return Field{Key: FieldError, Value: err}
+}
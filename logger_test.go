@@ -0,0 +1,82 @@
+package consulresolver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogFnLogger(t *testing.T) {
+	var lines []string
+	logger := LogFnLogger{Fn: func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}, MinLevel: LevelInfo}
+
+	logger.Log(LevelDebug, "dropped")
+	withComponent(logger, componentResolver).Log(LevelWarn, "failure querying service",
+		serviceField("orders"), datacenterField(""), Field{Key: FieldBackoff, Value: 1500 * time.Millisecond},
+		errorField(errors.New("connection refused")))
+
+	assert.Equal(t, []string{`[Consul Resolver] failure querying service service=orders datacenter="" backoff=1.5s error="connection refused"`}, lines)
+}
+
+func TestComponentLogger(t *testing.T) {
+	logger := &recordingLogger{}
+
+	// attaching a component replaces the one already attached
+	withComponent(withComponent(logger, componentTransport), componentLazy).Log(LevelInfo, "evicted idle resolver", serviceField("orders"))
+
+	assert.Equal(t, []string{"evicted idle resolver"}, logger.messages)
+	assert.Equal(t, [][]Field{{{Key: FieldComponent, Value: componentLazy}, serviceField("orders")}}, logger.fields)
+}
+
+func TestTransportLogsUnknownHostsAtDebugLevel(t *testing.T) {
+	logger := &recordingLogger{}
+	transport, err := NewLoadBalancedTransport(TransportConfig{
+		Resolvers: []Resolver{&staticNameResolver{name: "orders"}},
+		Logger:    logger,
+		Base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+		}),
+	})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	require.NoError(t, err)
+	_, err = transport.RoundTrip(req)
+	require.NoError(t, err)
+
+	require.Len(t, logger.levels, 1)
+	assert.Equal(t, LevelDebug, logger.levels[0])
+	assert.Equal(t, "no resolver found for host", logger.messages[0])
+	assert.Contains(t, logger.fields[0], Field{Key: FieldComponent, Value: componentTransport})
+
+	// the default logger drops debug messages
+	var lines int
+	transport, err = NewLoadBalancedTransport(TransportConfig{
+		Resolvers: []Resolver{&staticNameResolver{name: "orders"}},
+		Log:       func(string, ...interface{}) { lines++ },
+		Base:      transport.base,
+	})
+	require.NoError(t, err)
+	_, err = transport.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Zero(t, lines)
+}
+
+type recordingLogger struct {
+	levels   []Level
+	messages []string
+	fields   [][]Field
+}
+
+func (l *recordingLogger) Log(level Level, msg string, fields ...Field) {
+	l.levels = append(l.levels, level)
+	l.messages = append(l.messages, msg)
+	l.fields = append(l.fields, fields)
+}
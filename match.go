@@ -0,0 +1,141 @@
+package consulresolver
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/friendsofgo/errors"
+)
+
+// HostMatch describes the service a host refers to
+type HostMatch struct {
+	// The name of the service
+	ServiceName string
+	// The datacenter of the service, if the host refers to a specific one.
+	// An empty value matches resolvers that are not bound to a specific datacenter.
+	Datacenter string
+}
+
+// HostMatcher maps a hostname to a service
+type HostMatcher interface {
+	// Match returns the service the host (without a port) refers to, and whether the host matched at all
+	Match(host string) (HostMatch, bool)
+}
+
+// ConsulDomainMatcher matches hosts in Consul's DNS format - `<service>.service.consul` and `<service>.service.<dc>.consul`
+type ConsulDomainMatcher struct {
+	// The Consul DNS domain
+	// Optional
+	// Default: consul
+	Domain string
+}
+
+func (m ConsulDomainMatcher) Match(host string) (HostMatch, bool) {
+	domain := m.Domain
+	if domain == "" {
+		domain = "consul"
+	}
+
+	name := strings.TrimSuffix(host, "."+domain)
+	if name == host {
+		return HostMatch{}, false
+	}
+
+	// <service>.service
+	if svc := strings.TrimSuffix(name, ".service"); svc != name {
+		return HostMatch{ServiceName: svc}, svc != "" && !strings.Contains(svc, ".")
+	}
+
+	// <service>.service.<dc>
+	parts := strings.Split(name, ".")
+	if len(parts) != 3 || parts[1] != "service" || parts[0] == "" || parts[2] == "" {
+		return HostMatch{}, false
+	}
+	return HostMatch{ServiceName: parts[0], Datacenter: parts[2]}, true
+}
+
+// SuffixMatcher matches hosts ending with one of the provided suffixes, and strips the suffix to obtain the service name.
+// e.g. `orders.internal` will match the `orders` service given the `.internal` suffix.
+type SuffixMatcher struct {
+	Suffixes []string
+}
+
+func (m SuffixMatcher) Match(host string) (HostMatch, bool) {
+	for _, suffix := range m.Suffixes {
+		if name := strings.TrimSuffix(host, suffix); name != host && name != "" {
+			return HostMatch{ServiceName: name}, true
+		}
+	}
+	return HostMatch{}, false
+}
+
+// RegexpMatcher matches hosts against a regular expression, which must match the entire host.
+// The service name is taken from the `service` named group, or from the first group if no such group exists.
+// The datacenter is taken from the `dc` named group, if such group exists.
+// Matchers created by NewRegexpMatcher anchor the pattern once, while other matchers anchor it on every match.
+// A matcher without a pattern matches no host.
+type RegexpMatcher struct {
+	Pattern *regexp.Regexp
+	// the pattern, anchored to match the entire host
+	anchored *regexp.Regexp
+}
+
+// NewRegexpMatcher creates a RegexpMatcher matching hosts against the given regular expression
+func NewRegexpMatcher(pattern string) (RegexpMatcher, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return RegexpMatcher{}, errors.Wrap(err, "invalid host pattern")
+	}
+	return RegexpMatcher{Pattern: re, anchored: anchor(re)}, nil
+}
+
+func (m RegexpMatcher) Match(host string) (HostMatch, bool) {
+	if m.Pattern == nil {
+		return HostMatch{}, false
+	}
+	pattern := m.anchored
+	if pattern == nil {
+		pattern = anchor(m.Pattern)
+	}
+
+	groups := pattern.FindStringSubmatch(host)
+	if groups == nil {
+		return HostMatch{}, false
+	}
+
+	group := func(i int) string {
+		if i < 0 || i >= len(groups) {
+			return ""
+		}
+		return groups[i]
+	}
+
+	serviceIndex := pattern.SubexpIndex("service")
+	if serviceIndex < 0 {
+		serviceIndex = 1
+	}
+
+	match := HostMatch{ServiceName: group(serviceIndex), Datacenter: group(pattern.SubexpIndex("dc"))}
+	return match, match.ServiceName != ""
+}
+
+// anchor returns the given pattern, anchored to match entire strings.
+// Unlike checking the bounds of a match, alternations whose leftmost match is partial (e.g. `a|ab`) match correctly.
+func anchor(re *regexp.Regexp) *regexp.Regexp {
+	return regexp.MustCompile(`^(?:` + re.String() + `)$`)
+}
+
+// GlobMatcher matches hosts against a glob pattern (see path.Match), and maps them to a fixed service
+type GlobMatcher struct {
+	Pattern     string
+	ServiceName string
+	Datacenter  string
+}
+
+func (m GlobMatcher) Match(host string) (HostMatch, bool) {
+	if ok, err := path.Match(m.Pattern, host); err != nil || !ok {
+		return HostMatch{}, false
+	}
+	return HostMatch{ServiceName: m.ServiceName, Datacenter: m.Datacenter}, true
+}
@@ -0,0 +1,69 @@
+package consulresolver
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostMatchers(t *testing.T) {
+	tests := []struct {
+		name      string
+		matcher   HostMatcher
+		host      string
+		wantMatch HostMatch
+		wantOK    bool
+	}{
+		{name: "consul domain", matcher: ConsulDomainMatcher{}, host: "orders.service.consul",
+			wantMatch: HostMatch{ServiceName: "orders"}, wantOK: true},
+		{name: "consul domain with dc", matcher: ConsulDomainMatcher{}, host: "orders.service.dc2.consul",
+			wantMatch: HostMatch{ServiceName: "orders", Datacenter: "dc2"}, wantOK: true},
+		{name: "consul custom domain", matcher: ConsulDomainMatcher{Domain: "discovery"}, host: "orders.service.discovery",
+			wantMatch: HostMatch{ServiceName: "orders"}, wantOK: true},
+		{name: "consul node domain", matcher: ConsulDomainMatcher{}, host: "node1.node.consul"},
+		{name: "consul tag domain", matcher: ConsulDomainMatcher{}, host: "primary.orders.service.consul"},
+		{name: "consul other domain", matcher: ConsulDomainMatcher{}, host: "orders.internal"},
+		{name: "suffix", matcher: SuffixMatcher{Suffixes: []string{".svc", ".internal"}}, host: "orders.internal",
+			wantMatch: HostMatch{ServiceName: "orders"}, wantOK: true},
+		{name: "suffix only", matcher: SuffixMatcher{Suffixes: []string{".internal"}}, host: ".internal"},
+		{name: "suffix no match", matcher: SuffixMatcher{Suffixes: []string{".internal"}}, host: "orders"},
+		{name: "regexp named groups", matcher: RegexpMatcher{Pattern: regexp.MustCompile(`(?P<service>\w+)-(?P<dc>\w+)\.example\.com`)},
+			host: "orders-dc1.example.com", wantMatch: HostMatch{ServiceName: "orders", Datacenter: "dc1"}, wantOK: true},
+		{name: "regexp first group", matcher: RegexpMatcher{Pattern: regexp.MustCompile(`api\.(\w+)\.example\.com`)},
+			host: "api.orders.example.com", wantMatch: HostMatch{ServiceName: "orders"}, wantOK: true},
+		{name: "regexp partial match", matcher: RegexpMatcher{Pattern: regexp.MustCompile(`(\w+)\.example\.com`)},
+			host: "orders.example.com.evil.com"},
+		{name: "regexp alternation", matcher: RegexpMatcher{Pattern: regexp.MustCompile(`(orders|orders-v2)`)},
+			host: "orders-v2", wantMatch: HostMatch{ServiceName: "orders-v2"}, wantOK: true},
+		{name: "regexp constructor", matcher: mustRegexpMatcher(t, `(?P<dc>\w+)\.(?P<service>\w+|\w+-\w+)\.internal`),
+			host: "dc2.orders-v2.internal", wantMatch: HostMatch{ServiceName: "orders-v2", Datacenter: "dc2"}, wantOK: true},
+		{name: "regexp without pattern", matcher: RegexpMatcher{}, host: "orders"},
+		{name: "glob", matcher: GlobMatcher{Pattern: "orders-*.example.com", ServiceName: "orders"},
+			host: "orders-v2.example.com", wantMatch: HostMatch{ServiceName: "orders"}, wantOK: true},
+		{name: "glob no match", matcher: GlobMatcher{Pattern: "orders-*.example.com", ServiceName: "orders"},
+			host: "users-v2.example.com"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			match, ok := tt.matcher.Match(tt.host)
+			assert.Equal(t, tt.wantOK, ok)
+			if tt.wantOK {
+				assert.Equal(t, tt.wantMatch, match)
+			}
+		})
+	}
+}
+
+func TestNewRegexpMatcherInvalidPattern(t *testing.T) {
+	_, err := NewRegexpMatcher(`(orders`)
+	assert.Error(t, err)
+}
+
+func mustRegexpMatcher(t *testing.T, pattern string) RegexpMatcher {
+	m, err := NewRegexpMatcher(pattern)
+	require.NoError(t, err)
+	return m
+}
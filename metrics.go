@@ -0,0 +1,47 @@
+package consulresolver
+
+import "time"
+
+// RoundTripOutcome describes how a LoadBalancedTransport round trip ended
+type RoundTripOutcome string
+
+const (
+	// RoundTripSuccess means a response was received from the resolved instance
+	RoundTripSuccess RoundTripOutcome = "success"
+	// RoundTripError means the request to the resolved instance failed
+	RoundTripError RoundTripOutcome = "error"
+	// RoundTripResolveError means resolving an instance failed, and the request was not sent
+	RoundTripResolveError RoundTripOutcome = "resolve_error"
+	// RoundTripFallback means resolving an instance failed, and the request was sent using the base transport
+	RoundTripFallback RoundTripOutcome = "fallback"
+)
+
+// Metrics receives the measurements of resolvers and transports.
+// Implementations must be safe for concurrent use, and must not block.
+// The prommetrics package provides a Prometheus implementation.
+type Metrics interface {
+	// DiscoveryQuery is called after every query of the discovery backend (e.g. a Consul blocking query),
+	// with its duration and error, which is nil on success
+	DiscoveryQuery(service, datacenter string, duration time.Duration, err error)
+	// DiscoveryBackoff is called whenever a failed query is retried after the given delay
+	DiscoveryBackoff(service, datacenter string, delay time.Duration)
+	// Targets is called whenever the instances of a datacenter are received, with their count
+	Targets(service, datacenter string, count int)
+	// ActiveDatacenter is called whenever the datacenter whose instances are used changes, including the initial selection
+	ActiveDatacenter(service, previous, current string, reason TargetsChangeReason)
+	// Resolve is called after every resolution, with the ID of the selected instance (empty on error)
+	Resolve(service, instanceID string, duration time.Duration, err error)
+	// RoundTrip is called after every round trip of a request whose host was resolved by a LoadBalancedTransport.
+	// statusCode is 0 if no response was received.
+	RoundTrip(service string, outcome RoundTripOutcome, statusCode int, duration time.Duration)
+}
+
+// noopMetrics is the default Metrics, which discards all measurements
+type noopMetrics struct{}
+
+func (noopMetrics) DiscoveryQuery(string, string, time.Duration, error)          {}
+func (noopMetrics) DiscoveryBackoff(string, string, time.Duration)               {}
+func (noopMetrics) Targets(string, string, int)                                  {}
+func (noopMetrics) ActiveDatacenter(string, string, string, TargetsChangeReason) {}
+func (noopMetrics) Resolve(string, string, time.Duration, error)                 {}
+func (noopMetrics) RoundTrip(string, RoundTripOutcome, int, time.Duration)       {}
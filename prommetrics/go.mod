@@ -0,0 +1,10 @@
+module github.com/AppsFlyer/go-consul-resolver/prommetrics
+
+go 1.15
+
+require (
+	github.com/AppsFlyer/go-consul-resolver v0.0.0-20261018183758-725bf6d791f2
+	github.com/friendsofgo/errors v0.9.2
+	github.com/prometheus/client_golang v1.12.2
+	github.com/stretchr/testify v1.7.1
+)
@@ -0,0 +1,185 @@
+// Package prommetrics provides a Prometheus implementation of the resolver's Metrics interface
+package prommetrics
+
+import (
+	"strconv"
+	"time"
+
+	consulresolver "github.com/AppsFlyer/go-consul-resolver"
+	"github.com/friendsofgo/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultNamespace = "consul_resolver"
+
+type Config struct {
+	// The registerer the collectors are registered with
+	// Optional
+	// Default: prometheus.DefaultRegisterer
+	Registerer prometheus.Registerer
+	// The namespace of the metrics
+	// Optional
+	// Default: "consul_resolver"
+	Namespace string
+	// If true, the selections of every instance are counted, labeled by the instance ID.
+	// Note that this creates a time series per instance, which may be expensive for large services.
+	// Optional
+	// Default: false
+	InstanceSelections bool
+	// The buckets of the resolution and round trip duration histograms
+	// Optional
+	// Default: prometheus.DefBuckets
+	Buckets []float64
+}
+
+// Metrics implements consulresolver.Metrics using Prometheus collectors
+type Metrics struct {
+	queries            *prometheus.CounterVec
+	queryDuration      *prometheus.HistogramVec
+	backoffs           *prometheus.CounterVec
+	targets            *prometheus.GaugeVec
+	activeDatacenter   *prometheus.GaugeVec
+	datacenterChanges  *prometheus.CounterVec
+	resolutions        *prometheus.CounterVec
+	resolveDuration    *prometheus.HistogramVec
+	selections         *prometheus.CounterVec
+	roundTrips         *prometheus.CounterVec
+	roundTripDuration  *prometheus.HistogramVec
+	instanceSelections bool
+}
+
+var _ consulresolver.Metrics = &Metrics{}
+
+// New creates the collectors, and registers them with the config's registerer
+func New(conf Config) (*Metrics, error) {
+	if conf.Registerer == nil {
+		conf.Registerer = prometheus.DefaultRegisterer
+	}
+	if conf.Namespace == "" {
+		conf.Namespace = defaultNamespace
+	}
+	if len(conf.Buckets) == 0 {
+		conf.Buckets = prometheus.DefBuckets
+	}
+
+	m := &Metrics{
+		queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: conf.Namespace,
+			Name:      "discovery_queries_total",
+			Help:      "The number of discovery backend queries, by result.",
+		}, []string{"service", "datacenter", "result"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: conf.Namespace,
+			Name:      "discovery_query_duration_seconds",
+			Help:      "The duration of discovery backend queries, including the time blocking queries waited for changes.",
+			Buckets:   []float64{.01, .05, .1, .5, 1, 5, 30, 60, 300, 600},
+		}, []string{"service", "datacenter"}),
+		backoffs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: conf.Namespace,
+			Name:      "discovery_backoffs_total",
+			Help:      "The number of times a failed discovery backend query was retried after backing off.",
+		}, []string{"service", "datacenter"}),
+		targets: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: conf.Namespace,
+			Name:      "targets",
+			Help:      "The number of instances last received for every datacenter.",
+		}, []string{"service", "datacenter"}),
+		activeDatacenter: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: conf.Namespace,
+			Name:      "active_datacenter",
+			Help:      "1 for the datacenter whose instances are used, and 0 for datacenters that were previously used.",
+		}, []string{"service", "datacenter"}),
+		datacenterChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: conf.Namespace,
+			Name:      "datacenter_changes_total",
+			Help:      "The number of changes of the active datacenter, by reason.",
+		}, []string{"service", "reason"}),
+		resolutions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: conf.Namespace,
+			Name:      "resolutions_total",
+			Help:      "The number of resolutions, by result.",
+		}, []string{"service", "result"}),
+		resolveDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: conf.Namespace,
+			Name:      "resolve_duration_seconds",
+			Help:      "The duration of resolutions, including waiting for the resolver to become ready.",
+			Buckets:   conf.Buckets,
+		}, []string{"service"}),
+		selections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: conf.Namespace,
+			Name:      "instance_selections_total",
+			Help:      "The number of times every instance was selected.",
+		}, []string{"service", "instance"}),
+		roundTrips: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: conf.Namespace,
+			Name:      "round_trips_total",
+			Help:      "The number of transport round trips, by outcome and status code.",
+		}, []string{"service", "outcome", "code"}),
+		roundTripDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: conf.Namespace,
+			Name:      "round_trip_duration_seconds",
+			Help:      "The duration of transport round trips, including resolution.",
+			Buckets:   conf.Buckets,
+		}, []string{"service", "outcome"}),
+		instanceSelections: conf.InstanceSelections,
+	}
+
+	collectors := []prometheus.Collector{
+		m.queries, m.queryDuration, m.backoffs, m.targets, m.activeDatacenter, m.datacenterChanges,
+		m.resolutions, m.resolveDuration, m.roundTrips, m.roundTripDuration,
+	}
+	if conf.InstanceSelections {
+		collectors = append(collectors, m.selections)
+	}
+	for _, c := range collectors {
+		if err := conf.Registerer.Register(c); err != nil {
+			return nil, errors.Wrap(err, "failed registering resolver metrics")
+		}
+	}
+	return m, nil
+}
+
+func (m *Metrics) DiscoveryQuery(service, datacenter string, duration time.Duration, err error) {
+	m.queries.WithLabelValues(service, datacenter, result(err)).Inc()
+	m.queryDuration.WithLabelValues(service, datacenter).Observe(duration.Seconds())
+}
+
+func (m *Metrics) DiscoveryBackoff(service, datacenter string, _ time.Duration) {
+	m.backoffs.WithLabelValues(service, datacenter).Inc()
+}
+
+func (m *Metrics) Targets(service, datacenter string, count int) {
+	m.targets.WithLabelValues(service, datacenter).Set(float64(count))
+}
+
+func (m *Metrics) ActiveDatacenter(service, previous, current string, reason consulresolver.TargetsChangeReason) {
+	if reason != consulresolver.ReasonInitial {
+		m.activeDatacenter.WithLabelValues(service, previous).Set(0)
+	}
+	m.activeDatacenter.WithLabelValues(service, current).Set(1)
+	m.datacenterChanges.WithLabelValues(service, string(reason)).Inc()
+}
+
+func (m *Metrics) Resolve(service, instanceID string, duration time.Duration, err error) {
+	m.resolutions.WithLabelValues(service, result(err)).Inc()
+	m.resolveDuration.WithLabelValues(service).Observe(duration.Seconds())
+	if m.instanceSelections && err == nil {
+		m.selections.WithLabelValues(service, instanceID).Inc()
+	}
+}
+
+func (m *Metrics) RoundTrip(service string, outcome consulresolver.RoundTripOutcome, statusCode int, duration time.Duration) {
+	code := ""
+	if statusCode > 0 {
+		code = strconv.Itoa(statusCode)
+	}
+	m.roundTrips.WithLabelValues(service, string(outcome), code).Inc()
+	m.roundTripDuration.WithLabelValues(service, string(outcome)).Observe(duration.Seconds())
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
@@ -0,0 +1,93 @@
+package prommetrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	consulresolver "github.com/AppsFlyer/go-consul-resolver"
+	"github.com/friendsofgo/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	m, err := New(Config{Registerer: prometheus.NewRegistry(), InstanceSelections: true})
+	require.NoError(t, err)
+
+	m.DiscoveryQuery("orders", "dc1", time.Second, nil)
+	m.DiscoveryQuery("orders", "dc1", time.Second, errors.New("boom"))
+	m.DiscoveryBackoff("orders", "dc1", time.Second)
+	m.Targets("orders", "dc1", 3)
+	m.ActiveDatacenter("orders", "", "dc1", consulresolver.ReasonInitial)
+	m.ActiveDatacenter("orders", "dc1", "dc2", consulresolver.ReasonFailover)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.queries.WithLabelValues("orders", "dc1", "success")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.queries.WithLabelValues("orders", "dc1", "error")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.backoffs.WithLabelValues("orders", "dc1")))
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.targets.WithLabelValues("orders", "dc1")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.activeDatacenter.WithLabelValues("orders", "dc1")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.activeDatacenter.WithLabelValues("orders", "dc2")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.datacenterChanges.WithLabelValues("orders", "failover")))
+}
+
+func TestMetricsWithResolverAndTransport(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := New(Config{Registerer: registry, InstanceSelections: true})
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer srv.Close()
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	require.NoError(t, err)
+	p, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	r, err := consulresolver.NewStaticResolver(context.Background(), consulresolver.ResolverConfig{
+		ServiceSpec:  consulresolver.ServiceSpec{ServiceName: "orders"},
+		Metrics:      m,
+		WaitForReady: true,
+	}, consulresolver.StaticInstance{ID: "orders-1", Address: host, Port: p})
+	require.NoError(t, err)
+
+	tr, err := consulresolver.NewLoadBalancedTransport(consulresolver.TransportConfig{
+		Resolvers: []consulresolver.Resolver{r},
+		Metrics:   m,
+	})
+	require.NoError(t, err)
+	defer tr.Close()
+
+	res, err := (&http.Client{Transport: tr}).Get("http://orders/")
+	require.NoError(t, err)
+	_ = res.Body.Close()
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.queries.WithLabelValues("orders", "", "success")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.targets.WithLabelValues("orders", "")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.activeDatacenter.WithLabelValues("orders", "")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.resolutions.WithLabelValues("orders", "success")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.selections.WithLabelValues("orders", "orders-1")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.roundTrips.WithLabelValues("orders", "success", "418")))
+
+	// a closed resolver fails to resolve
+	require.NoError(t, r.Close())
+	_, err = (&http.Client{Transport: tr}).Get("http://orders/")
+	assert.Error(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.resolutions.WithLabelValues("orders", "error")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.roundTrips.WithLabelValues("orders", "resolve_error", "")))
+}
+
+func TestMetricsRegistrationConflict(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	_, err := New(Config{Registerer: registry})
+	require.NoError(t, err)
+	_, err = New(Config{Registerer: registry})
+	assert.Error(t, err)
+}
@@ -0,0 +1,257 @@
+package consulresolver
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DatacenterResolver is implemented by resolvers that are bound to a specific datacenter.
+// Such resolvers are only selected for hosts that refer to their datacenter (e.g. `<service>.service.<dc>.consul`).
+type DatacenterResolver interface {
+	Resolver
+	// Datacenter returns the datacenter the resolver is bound to, or an empty string if it uses the local datacenter
+	Datacenter() string
+}
+
+type resolverKey struct {
+	service    string
+	datacenter string
+}
+
+// registryState is an immutable snapshot of the registered resolvers, replaced as a whole on every change
+type registryState struct {
+	resolvers map[resolverKey]Resolver
+	hosts     map[string]Resolver
+}
+
+// resolverRegistry selects the resolver matching a given host.
+// Lookups are lock free, while changes are serialized and copy the registered resolvers.
+type resolverRegistry struct {
+	mu       sync.Mutex
+	state    atomic.Value
+	matchers []HostMatcher
+	lazy     *lazyResolvers
+}
+
+func newResolverRegistry(resolvers []Resolver, hosts map[string]Resolver, matchers []HostMatcher, lazy *lazyResolvers) *resolverRegistry {
+	state := &registryState{
+		resolvers: make(map[resolverKey]Resolver, len(resolvers)),
+		hosts:     make(map[string]Resolver, len(hosts)),
+	}
+	for _, r := range resolvers {
+		state.resolvers[keyOf(r)] = r
+	}
+	for host, r := range hosts {
+		state.hosts[strings.ToLower(host)] = r
+	}
+
+	res := &resolverRegistry{
+		matchers: matchers,
+		lazy:     lazy,
+	}
+	res.state.Store(state)
+	return res
+}
+
+// lookup returns the resolver for the given host, which may include a port.
+// Explicitly mapped hosts take precedence, followed by an exact match of the service name, and then by the host matchers in order.
+// If lazy resolvers are enabled, a resolver is created for the first matcher match that has no registered resolver,
+// waiting for its creation until the given context is done.
+func (r *resolverRegistry) lookup(ctx context.Context, hostport string) (Resolver, bool) {
+	host := hostname(hostport)
+	state := r.load()
+
+	if res, ok := state.hosts[host]; ok {
+		return res, true
+	}
+
+	if res, ok := state.resolvers[resolverKey{service: host}]; ok {
+		return res, true
+	}
+
+	for _, m := range r.matchers {
+		match, ok := m.Match(host)
+		if !ok {
+			continue
+		}
+		key := resolverKey{service: strings.ToLower(match.ServiceName), datacenter: strings.ToLower(match.Datacenter)}
+		if res, ok := state.resolvers[key]; ok {
+			return res, true
+		}
+		if r.lazy != nil {
+			return r.lazy.get(ctx, HostMatch{ServiceName: key.service, Datacenter: key.datacenter})
+		}
+	}
+
+	return nil, false
+}
+
+// add registers the resolver, replacing and closing any resolver registered with the same service name and datacenter
+func (r *resolverRegistry) add(res Resolver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state := r.load()
+	key := keyOf(res)
+	replaced, ok := state.resolvers[key]
+	if ok && sameResolver(replaced, res) {
+		return
+	}
+
+	next := state.clone()
+	next.resolvers[key] = res
+	r.state.Store(next)
+
+	if ok && !next.contains(replaced) {
+		closeResolver(replaced)
+	}
+}
+
+// remove unregisters the resolver from the registry, and closes it.
+// It returns false if the resolver is not registered.
+func (r *resolverRegistry) remove(res Resolver) bool {
+	if r.lazy != nil && r.lazy.remove(res) {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state := r.load()
+	if !state.contains(res) {
+		return false
+	}
+
+	next := state.clone()
+	for key, registered := range next.resolvers {
+		if sameResolver(registered, res) {
+			delete(next.resolvers, key)
+		}
+	}
+	for host, registered := range next.hosts {
+		if sameResolver(registered, res) {
+			delete(next.hosts, host)
+		}
+	}
+	r.state.Store(next)
+
+	closeResolver(res)
+	return true
+}
+
+// list returns all the registered resolvers, including lazily created ones
+func (r *resolverRegistry) list() []Resolver {
+	state := r.load()
+
+	res := make([]Resolver, 0, len(state.resolvers)+len(state.hosts))
+	appendUnique := func(resolver Resolver) {
+		for _, listed := range res {
+			if sameResolver(listed, resolver) {
+				return
+			}
+		}
+		res = append(res, resolver)
+	}
+
+	for _, resolver := range state.resolvers {
+		appendUnique(resolver)
+	}
+	for _, resolver := range state.hosts {
+		appendUnique(resolver)
+	}
+	if r.lazy != nil {
+		for _, resolver := range r.lazy.list() {
+			appendUnique(resolver)
+		}
+	}
+	return res
+}
+
+// close unregisters and closes all the resolvers
+func (r *resolverRegistry) close() {
+	if r.lazy != nil {
+		r.lazy.close()
+	}
+
+	r.mu.Lock()
+	resolvers := r.list()
+	r.state.Store(&registryState{resolvers: map[resolverKey]Resolver{}, hosts: map[string]Resolver{}})
+	r.mu.Unlock()
+
+	for _, res := range resolvers {
+		closeResolver(res)
+	}
+}
+
+func (r *resolverRegistry) load() *registryState {
+	return r.state.Load().(*registryState)
+}
+
+func (s *registryState) clone() *registryState {
+	res := &registryState{
+		resolvers: make(map[resolverKey]Resolver, len(s.resolvers)),
+		hosts:     make(map[string]Resolver, len(s.hosts)),
+	}
+	for k, v := range s.resolvers {
+		res.resolvers[k] = v
+	}
+	for k, v := range s.hosts {
+		res.hosts[k] = v
+	}
+	return res
+}
+
+func (s *registryState) contains(res Resolver) bool {
+	for _, registered := range s.resolvers {
+		if sameResolver(registered, res) {
+			return true
+		}
+	}
+	for _, registered := range s.hosts {
+		if sameResolver(registered, res) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameResolver reports whether a and b are the same resolver.
+// Resolvers are compared by identity, so values of non-comparable types (e.g. structs holding a slice) never match,
+// rather than panicking.
+func sameResolver(a, b Resolver) bool {
+	t := reflect.TypeOf(a)
+	if t != reflect.TypeOf(b) || (t != nil && !t.Comparable()) {
+		return false
+	}
+	return a == b
+}
+
+// closeResolver closes the resolver if it supports it
+func closeResolver(r Resolver) {
+	if c, ok := r.(io.Closer); ok {
+		_ = c.Close()
+	}
+}
+
+func keyOf(r Resolver) resolverKey {
+	key := resolverKey{service: strings.ToLower(r.ServiceName())}
+	if dr, ok := r.(DatacenterResolver); ok {
+		key.datacenter = strings.ToLower(dr.Datacenter())
+	}
+	return key
+}
+
+// hostname strips the port, IPv6 brackets and trailing dot from the given host, and lower-cases it
+func hostname(hostport string) string {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,163 @@
+package consulresolver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type staticNameResolver struct {
+	MockResolver
+	name       string
+	datacenter string
+}
+
+func (r *staticNameResolver) ServiceName() string {
+	return r.name
+}
+
+func (r *staticNameResolver) Datacenter() string {
+	return r.datacenter
+}
+
+func TestResolverRegistryLookup(t *testing.T) {
+	orders := &staticNameResolver{name: "orders"}
+	ordersDC2 := &staticNameResolver{name: "orders", datacenter: "dc2"}
+	legacy := &staticNameResolver{name: "legacy"}
+
+	registry := newResolverRegistry(
+		[]Resolver{orders, ordersDC2},
+		map[string]Resolver{"legacy.example.com": legacy},
+		[]HostMatcher{ConsulDomainMatcher{}, SuffixMatcher{Suffixes: []string{".internal"}}},
+		nil,
+	)
+
+	tests := []struct {
+		host string
+		want Resolver
+	}{
+		{host: "orders", want: orders},
+		{host: "orders:8080", want: orders},
+		{host: "ORDERS.", want: orders},
+		{host: "orders.internal:443", want: orders},
+		{host: "orders.service.consul", want: orders},
+		{host: "orders.service.dc2.consul", want: ordersDC2},
+		{host: "orders.service.dc3.consul", want: nil},
+		{host: "legacy.example.com:80", want: legacy},
+		{host: "legacy", want: nil},
+		{host: "[::1]:8080", want: nil},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.host, func(t *testing.T) {
+			r, ok := registry.lookup(context.Background(), tt.host)
+			assert.Equal(t, tt.want != nil, ok)
+			if tt.want != nil {
+				assert.Same(t, tt.want, r)
+			}
+		})
+	}
+}
+
+func TestHostname(t *testing.T) {
+	for hostport, want := range map[string]string{
+		"orders":                "orders",
+		"orders:80":             "orders",
+		"Orders.Example.com.":   "orders.example.com",
+		"[::1]:8080":            "::1",
+		"[fe80::1%25en0]":       "fe80::1%25en0",
+		"10.0.0.1:443":          "10.0.0.1",
+		"orders.service.consul": "orders.service.consul",
+	} {
+		assert.Equal(t, want, hostname(hostport), hostport)
+	}
+}
+
+type closableResolver struct {
+	staticNameResolver
+	closed bool
+}
+
+func (r *closableResolver) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestResolverRegistryAddRemove(t *testing.T) {
+	orders := &closableResolver{staticNameResolver: staticNameResolver{name: "orders"}}
+	registry := newResolverRegistry([]Resolver{orders}, nil, nil, nil)
+
+	users := &staticNameResolver{name: "users"}
+	registry.add(users)
+	r, ok := registry.lookup(context.Background(), "users")
+	assert.True(t, ok)
+	assert.Same(t, users, r)
+	assert.ElementsMatch(t, []Resolver{orders, users}, registry.list())
+
+	// replacing a resolver closes the previous one
+	replacement := &staticNameResolver{name: "orders"}
+	registry.add(replacement)
+	assert.True(t, orders.closed)
+	r, _ = registry.lookup(context.Background(), "orders")
+	assert.Same(t, replacement, r)
+
+	assert.False(t, registry.remove(orders))
+	assert.True(t, registry.remove(users))
+	_, ok = registry.lookup(context.Background(), "users")
+	assert.False(t, ok)
+	assert.ElementsMatch(t, []Resolver{replacement}, registry.list())
+}
+
+// sliceResolver is a non-comparable resolver, as it holds a slice
+type sliceResolver struct {
+	*MockResolver
+	tags []string
+}
+
+func (r sliceResolver) ServiceName() string {
+	return "tagged"
+}
+
+func TestResolverRegistryNonComparableResolvers(t *testing.T) {
+	tagged := sliceResolver{MockResolver: &MockResolver{}, tags: []string{"v1"}}
+	users := &staticNameResolver{name: "users"}
+	registry := newResolverRegistry([]Resolver{tagged}, map[string]Resolver{"tagged.example.com": tagged}, nil, nil)
+
+	assert.NotPanics(t, func() {
+		registry.add(users)
+		registry.add(tagged)
+		assert.Contains(t, registry.list(), users)
+		assert.False(t, registry.remove(tagged))
+		assert.True(t, registry.remove(users))
+	})
+	r, ok := registry.lookup(context.Background(), "tagged")
+	assert.True(t, ok)
+	assert.Equal(t, tagged, r)
+}
+
+func TestResolverRegistryConcurrentChanges(t *testing.T) {
+	registry := newResolverRegistry(nil, nil, nil, nil)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		r := &staticNameResolver{name: fmt.Sprintf("service-%d", i)}
+		go func() {
+			defer wg.Done()
+			registry.add(r)
+			registry.remove(r)
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				registry.lookup(context.Background(), r.name)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Empty(t, registry.list())
+}
@@ -0,0 +1,53 @@
+//go:build go1.21
+// +build go1.21
+
+// Package slogadapter adapts log/slog loggers to the Logger interface of resolvers, transports and dialers
+package slogadapter
+
+import (
+	"context"
+	"log/slog"
+
+	consulresolver "github.com/AppsFlyer/go-consul-resolver"
+)
+
+// Logger writes the messages of resolvers, transports and dialers to a slog.Logger, passing their fields as attributes
+type Logger struct {
+	logger *slog.Logger
+}
+
+// New creates a Logger writing to the given slog.Logger, or to slog.Default() if it is nil
+func New(logger *slog.Logger) *Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Logger{logger: logger}
+}
+
+func (l *Logger) Log(level consulresolver.Level, msg string, fields ...consulresolver.Field) {
+	ctx := context.Background()
+	lvl := Level(level)
+	if !l.logger.Enabled(ctx, lvl) {
+		return
+	}
+
+	attrs := make([]slog.Attr, len(fields))
+	for i, f := range fields {
+		attrs[i] = slog.Any(f.Key, f.Value)
+	}
+	l.logger.LogAttrs(ctx, lvl, msg, attrs...)
+}
+
+// Level returns the slog level matching the given level
+func Level(level consulresolver.Level) slog.Level {
+	switch level {
+	case consulresolver.LevelDebug:
+		return slog.LevelDebug
+	case consulresolver.LevelInfo:
+		return slog.LevelInfo
+	case consulresolver.LevelWarn:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
@@ -0,0 +1,41 @@
+//go:build go1.21
+// +build go1.21
+
+package slogadapter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	consulresolver "github.com/AppsFlyer/go-consul-resolver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	logger.Log(consulresolver.LevelDebug, "dropped", consulresolver.Field{Key: consulresolver.FieldHost, Value: "example.com"})
+	assert.Zero(t, buf.Len())
+
+	logger.Log(consulresolver.LevelWarn, "failure querying service",
+		consulresolver.Field{Key: consulresolver.FieldService, Value: "orders"},
+		consulresolver.Field{Key: consulresolver.FieldAttempt, Value: 3},
+		consulresolver.Field{Key: consulresolver.FieldBackoff, Value: 2 * time.Second},
+		consulresolver.Field{Key: consulresolver.FieldError, Value: errors.New("connection refused")},
+	)
+
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, "failure querying service", record["msg"])
+	assert.Equal(t, "orders", record["service"])
+	assert.Equal(t, float64(3), record["attempt"])
+	assert.Equal(t, float64(2*time.Second), record["backoff"])
+	assert.Equal(t, "connection refused", record["error"])
+}
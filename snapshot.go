@@ -0,0 +1,113 @@
+package consulresolver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/friendsofgo/errors"
+	"github.com/hashicorp/consul/api"
+)
+
+// SnapshotVersion is the version of the snapshot format written by the resolver
+const SnapshotVersion = 1
+
+// snapshotConfirmInterval is the minimal interval between saves of unchanged targets
+const snapshotConfirmInterval = time.Minute
+
+// Snapshot holds the last known targets of a resolver, used to seed the resolver when Consul is unavailable on startup
+type Snapshot struct {
+	Version     int    `json:"version"`
+	ServiceName string `json:"service_name"`
+	// The spec of the resolver that saved the snapshot. Resolvers ignore snapshots of other specs.
+	// Snapshots written by older versions do not have it, and are ignored as well.
+	Spec *SnapshotSpec `json:"spec,omitempty"`
+	// The time the targets were last changed
+	CreatedAt time.Time `json:"created_at"`
+	// The time the targets were last confirmed by a response from Consul, which is used for checking the snapshot's age.
+	// Snapshots written by older versions do not have it, in which case CreatedAt is used.
+	ConfirmedAt time.Time            `json:"confirmed_at,omitempty"`
+	Datacenters []SnapshotDatacenter `json:"datacenters"`
+}
+
+// SnapshotSpec identifies the instances a snapshot holds, beyond their service name
+type SnapshotSpec struct {
+	// The tags of the ServiceSpec, sorted
+	Tags             []string `json:"tags,omitempty"`
+	IncludeUnhealthy bool     `json:"include_unhealthy,omitempty"`
+	ServicePort      int      `json:"service_port,omitempty"`
+	// The datacenters of the resolver ordered by priority, where an empty name denotes the local datacenter
+	Datacenters []string `json:"datacenters"`
+}
+
+// SnapshotDatacenter holds the instances of a single datacenter.
+// An empty Name denotes the local datacenter.
+type SnapshotDatacenter struct {
+	Name      string              `json:"name"`
+	Instances []*api.ServiceEntry `json:"instances"`
+}
+
+// SnapshotStore persists resolver snapshots.
+// A store holds the snapshot of a single resolver, and must not be shared between resolvers.
+type SnapshotStore interface {
+	// Load returns the last saved snapshot, or nil if no snapshot exists
+	Load() (*Snapshot, error)
+	// Save persists the given snapshot, replacing any previously saved snapshot
+	Save(*Snapshot) error
+}
+
+// FileSnapshotStore persists snapshots to a local JSON file.
+// Snapshots are written atomically, by writing to a temporary file and renaming it.
+type FileSnapshotStore struct {
+	Path string
+}
+
+func (s FileSnapshotStore) Load() (*Snapshot, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading snapshot")
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, errors.Wrap(err, "failed decoding snapshot")
+	}
+
+	if snapshot.Version != SnapshotVersion {
+		return nil, errors.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+
+	return &snapshot, nil
+}
+
+func (s FileSnapshotStore) Save(snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return errors.Wrap(err, "failed encoding snapshot")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed creating temporary snapshot file")
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed writing snapshot")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed syncing snapshot")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed closing snapshot")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), s.Path), "failed replacing snapshot")
+}
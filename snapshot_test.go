@@ -0,0 +1,187 @@
+package consulresolver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSnapshotStore(t *testing.T) {
+	store := FileSnapshotStore{Path: filepath.Join(t.TempDir(), "snapshot.json")}
+
+	snapshot, err := store.Load()
+	assert.NoError(t, err)
+	assert.Nil(t, snapshot)
+
+	expected := newTestSnapshot(time.Now())
+	require.NoError(t, store.Save(expected))
+
+	snapshot, err = store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, expected.ServiceName, snapshot.ServiceName)
+	assert.Equal(t, expected.Spec, snapshot.Spec)
+	assert.Equal(t, expected.Datacenters, snapshot.Datacenters)
+	assert.True(t, expected.CreatedAt.Equal(snapshot.CreatedAt))
+
+	files, err := ioutil.ReadDir(filepath.Dir(store.Path))
+	require.NoError(t, err)
+	assert.Len(t, files, 1, "temporary files should be removed")
+
+	require.NoError(t, ioutil.WriteFile(store.Path, []byte(`{"version": 2}`), 0600))
+	_, err = store.Load()
+	assert.Error(t, err)
+}
+
+func TestServiceResolverSeedFromSnapshot(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	client, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
+	require.NoError(t, err)
+
+	store := FileSnapshotStore{Path: filepath.Join(t.TempDir(), "snapshot.json")}
+	require.NoError(t, store.Save(newTestSnapshot(time.Now().Add(-time.Hour))))
+
+	r, err := NewConsulResolver(context.Background(), ResolverConfig{
+		ServiceSpec:   ServiceSpec{ServiceName: "service"},
+		Client:        client,
+		SnapshotStore: store,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	addr, err := r.Resolve(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, ServiceAddress{Host: "10.0.0.1", Port: 8080}, addr)
+	assert.True(t, r.Stale())
+
+	expired, err := NewConsulResolver(context.Background(), ResolverConfig{
+		ServiceSpec:    ServiceSpec{ServiceName: "service"},
+		Client:         client,
+		SnapshotStore:  store,
+		SnapshotMaxAge: time.Minute,
+		InitTimeout:    10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer expired.Close()
+
+	_, err = expired.Resolve(context.Background())
+	assert.ErrorIs(t, err, ErrNotInitialized)
+}
+
+func TestServiceResolverIgnoresSnapshotsOfOtherSpecs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	client, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		conf   ResolverConfig
+		seeded bool
+	}{
+		{name: "same spec", conf: ResolverConfig{ServiceSpec: ServiceSpec{ServiceName: "service", Tags: []string{"b", "a"}}}, seeded: true},
+		{name: "other tags", conf: ResolverConfig{ServiceSpec: ServiceSpec{ServiceName: "service", Tags: []string{"a"}}}},
+		{name: "unhealthy", conf: ResolverConfig{ServiceSpec: ServiceSpec{ServiceName: "service", Tags: []string{"a", "b"}, IncludeUnhealthy: true}}},
+		{name: "other port", conf: ResolverConfig{ServiceSpec: ServiceSpec{ServiceName: "service", Tags: []string{"a", "b"}, ServicePort: 9090}}},
+		{name: "other datacenter", conf: ResolverConfig{ServiceSpec: ServiceSpec{ServiceName: "service", Tags: []string{"a", "b"}}, Datacenter: "dc2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot := newTestSnapshot(time.Now())
+			snapshot.Spec.Tags = []string{"a", "b"}
+			store := FileSnapshotStore{Path: filepath.Join(t.TempDir(), "snapshot.json")}
+			require.NoError(t, store.Save(snapshot))
+
+			conf := tt.conf
+			conf.Client = client
+			conf.SnapshotStore = store
+			conf.InitTimeout = 10 * time.Millisecond
+			r, err := NewConsulResolver(context.Background(), conf)
+			require.NoError(t, err)
+			defer r.Close()
+
+			_, err = r.Resolve(context.Background())
+			if tt.seeded {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrNotInitialized)
+			}
+		})
+	}
+}
+
+func TestServiceResolverSaveSnapshot(t *testing.T) {
+	client, _ := newFakeConsulClient(t)
+	store := FileSnapshotStore{Path: filepath.Join(t.TempDir(), "snapshot.json")}
+
+	r, err := NewConsulResolver(context.Background(), ResolverConfig{
+		ServiceSpec:   ServiceSpec{ServiceName: "service"},
+		Client:        client,
+		SnapshotStore: store,
+		WaitForReady:  true,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+	assert.False(t, r.Stale())
+
+	assert.Eventually(t, func() bool {
+		snapshot, err := store.Load()
+		return err == nil && snapshot != nil && len(snapshot.Datacenters) == 1 && len(snapshot.Datacenters[0].Instances) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServiceResolverConfirmSnapshot(t *testing.T) {
+	client, _ := newFakeConsulClient(t)
+	store := FileSnapshotStore{Path: filepath.Join(t.TempDir(), "snapshot.json")}
+	createdAt := time.Now().Add(-time.Hour)
+	snapshot := newTestSnapshot(createdAt)
+	snapshot.ConfirmedAt = time.Now().Add(-time.Second)
+	require.NoError(t, store.Save(snapshot))
+
+	// the snapshot's age is determined by the last time its targets were confirmed
+	r, err := NewConsulResolver(context.Background(), ResolverConfig{
+		ServiceSpec:    ServiceSpec{ServiceName: "service"},
+		Client:         client,
+		SnapshotStore:  store,
+		SnapshotMaxAge: time.Minute,
+		WaitForReady:   true,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	// unchanged targets refresh the confirmation time, keeping the creation time
+	assert.Eventually(t, func() bool {
+		saved, err := store.Load()
+		return err == nil && saved.ConfirmedAt.After(snapshot.ConfirmedAt)
+	}, time.Second, 10*time.Millisecond)
+	saved, err := store.Load()
+	require.NoError(t, err)
+	assert.True(t, createdAt.Equal(saved.CreatedAt))
+}
+
+func newTestSnapshot(createdAt time.Time) *Snapshot {
+	return &Snapshot{
+		Version:     SnapshotVersion,
+		ServiceName: "service",
+		Spec:        &SnapshotSpec{Datacenters: []string{""}},
+		CreatedAt:   createdAt,
+		Datacenters: []SnapshotDatacenter{{
+			Instances: []*api.ServiceEntry{{
+				Node:    &api.Node{ID: "node", Address: "10.0.0.1"},
+				Service: &api.AgentService{Service: "service", Port: 8080},
+			}},
+		}},
+	}
+}
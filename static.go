@@ -0,0 +1,338 @@
+package consulresolver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/friendsofgo/errors"
+	"github.com/fsnotify/fsnotify"
+	"github.com/hashicorp/consul/api"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultFilePollInterval = 5 * time.Second
+
+// StaticInstance is a statically defined instance of a service
+type StaticInstance struct {
+	// The address of the instance
+	// Mandatory
+	Address string `json:"address" yaml:"address"`
+	// The port of the instance
+	// Mandatory
+	Port int `json:"port" yaml:"port"`
+	// The ID of the instance
+	// Optional
+	// Default: address:port
+	ID string `json:"id,omitempty" yaml:"id,omitempty"`
+	// The name of the node running the instance
+	// Optional
+	// Default: the address
+	Node string `json:"node,omitempty" yaml:"node,omitempty"`
+	// The tags of the instance
+	// Optional
+	Tags []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	// The meta of the instance
+	// Optional
+	Meta map[string]string `json:"meta,omitempty" yaml:"meta,omitempty"`
+	// The weight of the instance, used by weighted balancers
+	// Optional
+	Weight int `json:"weight,omitempty" yaml:"weight,omitempty"`
+	// The datacenter of the instance.
+	// Optional. Instances without a datacenter are returned for every datacenter.
+	Datacenter string `json:"datacenter,omitempty" yaml:"datacenter,omitempty"`
+}
+
+// StaticServices maps service names to their instances
+type StaticServices map[string][]StaticInstance
+
+// StaticDiscovery discovers instances from a fixed list of instances per service.
+// Only instances having all the requested tags, and matching the requested datacenter, are returned.
+type StaticDiscovery struct {
+	Services StaticServices
+}
+
+// NewStaticResolver creates a resolver balancing between the given instances of the config's ServiceSpec
+func NewStaticResolver(ctx context.Context, conf ResolverConfig, instances ...StaticInstance) (*ServiceResolver, error) {
+	conf.Discovery = &StaticDiscovery{Services: StaticServices{conf.ServiceSpec.ServiceName: instances}}
+	return NewConsulResolver(ctx, conf)
+}
+
+// Watch returns the matching instances. As the instances never change, it blocks until the context is done if the request has a WaitIndex.
+func (d *StaticDiscovery) Watch(ctx context.Context, req DiscoveryRequest) (*DiscoveryResult, error) {
+	res := d.Services.result(req)
+	if req.WaitIndex != 0 && res.Index == req.WaitIndex {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return res, nil
+}
+
+// FileDiscovery discovers instances from a YAML or JSON file mapping service names to their instances, reloading it whenever it changes.
+// Files with a .yaml or .yml extension are parsed as YAML, and any other file is parsed as JSON.
+// Changes are detected using file system notifications when available, and by periodically polling the file.
+// The notifications of a FileDiscovery are shared by all its watches, and are stopped by Close.
+type FileDiscovery struct {
+	// The path of the file
+	// Mandatory
+	Path string
+	// The interval in which the file is polled for changes
+	// Optional
+	// Default: 5 seconds
+	PollInterval time.Duration
+
+	once    sync.Once
+	mu      sync.Mutex
+	watcher *fsnotify.Watcher
+	waiters map[chan struct{}]struct{}
+	closed  bool
+}
+
+// NewFileResolver creates a resolver balancing between the instances of the config's ServiceSpec listed in the given file
+func NewFileResolver(ctx context.Context, conf ResolverConfig, path string) (*ServiceResolver, error) {
+	if path == "" {
+		return nil, errors.New("file path must not be empty")
+	}
+	d := &FileDiscovery{Path: path}
+	conf.Discovery = d
+	r, err := NewConsulResolver(ctx, conf)
+	if err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+
+	// the discovery is owned by the resolver, so stop watching the file once the resolver is stopped
+	r.watchers.Add(1)
+	go func() {
+		defer r.watchers.Done()
+		<-r.ctx.Done()
+		_ = d.Close()
+	}()
+	return r, nil
+}
+
+// Watch loads the matching instances from the file. If the request has a WaitIndex, Watch keeps reloading the file
+// whenever it may have changed, until the matching instances change.
+func (d *FileDiscovery) Watch(ctx context.Context, req DiscoveryRequest) (*DiscoveryResult, error) {
+	var changes *fileChanges
+	if req.WaitIndex != 0 {
+		// start watching before loading the file, so that no change is missed
+		changes = d.watchChanges()
+		defer changes.close()
+	}
+
+	for {
+		services, err := d.load()
+		if err != nil {
+			return nil, err
+		}
+
+		res := services.result(req)
+		if res.Index != req.WaitIndex {
+			return res, nil
+		}
+
+		if err := changes.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (d *FileDiscovery) load() (StaticServices, error) {
+	data, err := ioutil.ReadFile(d.Path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading instances file")
+	}
+
+	var services StaticServices
+	switch strings.ToLower(filepath.Ext(d.Path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &services)
+	default:
+		err = json.Unmarshal(data, &services)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed parsing instances file")
+	}
+	return services, nil
+}
+
+// Close stops watching the file using file system notifications, after which changes are only detected by polling
+func (d *FileDiscovery) Close() error {
+	d.mu.Lock()
+	w := d.watcher
+	d.watcher = nil
+	d.closed = true
+	d.mu.Unlock()
+
+	if w != nil {
+		return w.Close()
+	}
+	return nil
+}
+
+// watch starts watching the file using file system notifications, once per FileDiscovery.
+// If notifications are not available, changes are only detected by polling.
+func (d *FileDiscovery) watch() {
+	d.once.Do(func() {
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			return
+		}
+		// watch the directory, so that files replaced by renaming are noticed as well
+		if err := w.Add(filepath.Dir(d.Path)); err != nil {
+			_ = w.Close()
+			return
+		}
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.closed {
+			_ = w.Close()
+			return
+		}
+		d.watcher = w
+		go d.dispatch(w)
+	})
+}
+
+// dispatch notifies the waiters of every change to the file, until the watcher is closed
+func (d *FileDiscovery) dispatch(w *fsnotify.Watcher) {
+	path := filepath.Clean(d.Path)
+	for {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == path {
+				d.notify()
+			}
+		case _, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			// errors (e.g. an overflow of events) may hide changes, so let the waiters reload the file
+			d.notify()
+		}
+	}
+}
+
+func (d *FileDiscovery) notify() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for waiter := range d.waiters {
+		select {
+		case waiter <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// fileChanges notifies of possible changes to a file
+type fileChanges struct {
+	discovery *FileDiscovery
+	notified  chan struct{}
+	ticker    *time.Ticker
+}
+
+// watchChanges watches the file using the discovery's file system notifications when available, and by polling it
+func (d *FileDiscovery) watchChanges() *fileChanges {
+	d.watch()
+
+	c := &fileChanges{discovery: d, notified: make(chan struct{}, 1), ticker: time.NewTicker(d.pollInterval())}
+	d.mu.Lock()
+	if d.waiters == nil {
+		d.waiters = map[chan struct{}]struct{}{}
+	}
+	d.waiters[c.notified] = struct{}{}
+	d.mu.Unlock()
+	return c
+}
+
+// wait blocks until the file may have changed, or the context is done
+func (c *fileChanges) wait(ctx context.Context) error {
+	select {
+	case <-c.notified:
+		return nil
+	case <-c.ticker.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *fileChanges) close() {
+	c.ticker.Stop()
+	c.discovery.mu.Lock()
+	delete(c.discovery.waiters, c.notified)
+	c.discovery.mu.Unlock()
+}
+
+func (d *FileDiscovery) pollInterval() time.Duration {
+	if d.PollInterval > 0 {
+		return d.PollInterval
+	}
+	return defaultFilePollInterval
+}
+
+// result returns the instances matching the request
+func (s StaticServices) result(req DiscoveryRequest) *DiscoveryResult {
+	var instances []*api.ServiceEntry
+	for _, instance := range s[req.ServiceName] {
+		if instance.Datacenter != "" && instance.Datacenter != req.Datacenter {
+			continue
+		}
+		if !hasTags(instance.Tags, req.Tags) {
+			continue
+		}
+		instances = append(instances, instance.entry(req.ServiceName))
+	}
+	return &DiscoveryResult{Instances: instances, Index: InstancesIndex(instances)}
+}
+
+func (i StaticInstance) entry(service string) *api.ServiceEntry {
+	id := i.ID
+	if id == "" {
+		id = net.JoinHostPort(i.Address, strconv.Itoa(i.Port))
+	}
+	node := i.Node
+	if node == "" {
+		node = i.Address
+	}
+	return &api.ServiceEntry{
+		Node: &api.Node{Node: node, Address: i.Address, Datacenter: i.Datacenter},
+		Service: &api.AgentService{
+			ID:      id,
+			Service: service,
+			Address: i.Address,
+			Port:    i.Port,
+			Tags:    i.Tags,
+			Meta:    i.Meta,
+			Weights: api.AgentWeights{Passing: i.Weight, Warning: i.Weight},
+		},
+		Checks: api.HealthChecks{},
+	}
+}
+
+func hasTags(tags, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, t := range tags {
+			if t == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+package consulresolver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticResolver(t *testing.T) {
+	r, err := NewStaticResolver(context.Background(), ResolverConfig{
+		ServiceSpec:  ServiceSpec{ServiceName: "orders", Tags: []string{"v2"}},
+		WaitForReady: true,
+	},
+		StaticInstance{Address: "10.0.0.1", Port: 8080, Tags: []string{"v1"}},
+		StaticInstance{Address: "10.0.0.2", Port: 8080, Tags: []string{"v2", "canary"}, Meta: map[string]string{"zone": "a"}},
+		StaticInstance{Address: "10.0.0.3", Port: 8081, Tags: []string{"v2"}},
+	)
+	require.NoError(t, err)
+	defer r.Close()
+
+	addrs, err := r.ResolveAll(context.Background())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []ServiceAddress{{Host: "10.0.0.2", Port: 8080}, {Host: "10.0.0.3", Port: 8081}}, addrs)
+}
+
+func TestStaticDiscoveryDatacenters(t *testing.T) {
+	d := &StaticDiscovery{Services: StaticServices{"orders": {
+		{Address: "10.0.0.1", Port: 8080, Datacenter: "dc1"},
+		{Address: "10.0.0.2", Port: 8080},
+	}}}
+
+	res, err := d.Watch(context.Background(), DiscoveryRequest{ServiceName: "orders", Datacenter: "dc2"})
+	require.NoError(t, err)
+	require.Len(t, res.Instances, 1)
+	assert.Equal(t, "10.0.0.2", res.Instances[0].Service.Address)
+
+	// the instances never change, so watching blocks until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = d.Watch(ctx, DiscoveryRequest{ServiceName: "orders", Datacenter: "dc2", WaitIndex: res.Index})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestFileResolverYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	writeFileAtomically(t, path, `
+orders:
+  - address: 10.0.0.1
+    port: 8080
+    meta:
+      zone: a
+`)
+
+	r, err := NewFileResolver(context.Background(), ResolverConfig{
+		ServiceSpec:  ServiceSpec{ServiceName: "orders"},
+		WaitForReady: true,
+	}, path)
+	require.NoError(t, err)
+	defer r.Close()
+
+	addr, err := r.Resolve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, ServiceAddress{Host: "10.0.0.1", Port: 8080}, addr)
+
+	// replacing the file is noticed using file system notifications, well before the file is polled
+	writeFileAtomically(t, path, `
+orders:
+  - address: 10.0.0.2
+    port: 9090
+`)
+	assert.Eventually(t, func() bool {
+		addr, err := r.Resolve(context.Background())
+		return err == nil && addr == ServiceAddress{Host: "10.0.0.2", Port: 9090}
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestFileDiscoveryJSONPolling(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.json")
+	writeFileAtomically(t, path, `{"orders": [{"address": "10.0.0.1", "port": 8080}]}`)
+
+	d := &FileDiscovery{Path: path, PollInterval: 10 * time.Millisecond}
+	res, err := d.Watch(context.Background(), DiscoveryRequest{ServiceName: "orders"})
+	require.NoError(t, err)
+	require.Len(t, res.Instances, 1)
+
+	written := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		written <- replaceFile(path, `{"orders": [{"address": "10.0.0.1", "port": 8080, "weight": 3}]}`)
+	}()
+
+	changed, err := d.Watch(context.Background(), DiscoveryRequest{ServiceName: "orders", WaitIndex: res.Index})
+	require.NoError(t, <-written)
+	require.NoError(t, err)
+	require.Len(t, changed.Instances, 1)
+	assert.Equal(t, 3, changed.Instances[0].Service.Weights.Passing)
+	assert.NotEqual(t, res.Index, changed.Index)
+}
+
+func TestFileDiscoverySharedWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.json")
+	writeFileAtomically(t, path, `{"orders": [{"address": "10.0.0.1", "port": 8080}], "users": [{"address": "10.0.0.2", "port": 8080}]}`)
+
+	// changes are only noticed using file system notifications, as the file is not polled during the test
+	d := &FileDiscovery{Path: path, PollInterval: time.Hour}
+	defer d.Close()
+	changed := make(chan error, 2)
+	for _, service := range []string{"orders", "users"} {
+		res, err := d.Watch(context.Background(), DiscoveryRequest{ServiceName: service})
+		require.NoError(t, err)
+		go func(service string, index uint64) {
+			_, err := d.Watch(context.Background(), DiscoveryRequest{ServiceName: service, WaitIndex: index})
+			changed <- err
+		}(service, res.Index)
+	}
+
+	assert.Eventually(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.watcher != nil && len(d.waiters) == 2
+	}, time.Second, 10*time.Millisecond)
+	writeFileAtomically(t, path, `{"orders": [{"address": "10.0.0.3", "port": 8080}], "users": [{"address": "10.0.0.4", "port": 8080}]}`)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-changed:
+			assert.NoError(t, err)
+		case <-time.After(3 * time.Second):
+			t.Fatal("change was not noticed")
+		}
+	}
+
+	require.NoError(t, d.Close())
+	assert.Nil(t, d.watcher)
+}
+
+func TestFileDiscoveryInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.json")
+	writeFileAtomically(t, path, `{"orders": `)
+
+	_, err := (&FileDiscovery{Path: path}).Watch(context.Background(), DiscoveryRequest{ServiceName: "orders"})
+	assert.Error(t, err)
+}
+
+func writeFileAtomically(t *testing.T, path, content string) {
+	require.NoError(t, replaceFile(path, content))
+}
+
+// replaceFile replaces the file's content by renaming a temporary file
+func replaceFile(path, content string) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
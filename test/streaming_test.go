@@ -0,0 +1,125 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consulresolver "github.com/AppsFlyer/go-consul-resolver"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStreamingBackend runs against a local Consul (1.10+) dev agent with the streaming backend enabled.
+// It is skipped if the consul binary is not available in the PATH.
+func TestStreamingBackend(t *testing.T) {
+	backends := &queryBackendRecorder{next: http.DefaultTransport}
+	client := startLocalConsulAgent(t, "use_streaming_backend = true", backends)
+
+	require.NoError(t, registerServiceInConsul(0, serviceName, nil, client))
+
+	resolver, err := consulresolver.NewConsulResolver(context.Background(), consulresolver.ResolverConfig{
+		ServiceSpec:     consulresolver.ServiceSpec{ServiceName: serviceName},
+		Client:          client,
+		PreferStreaming: true,
+		WaitForReady:    true,
+		InitTimeout:     10 * time.Second,
+	})
+	require.NoError(t, err)
+	defer resolver.Close()
+
+	assert.Equal(t, consulresolver.QueryBackendStreaming, resolver.Backend())
+
+	addr, err := resolver.Resolve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "service_0", addr.Host)
+
+	// Make sure changes are streamed to the resolver
+	require.NoError(t, deregisterServiceInConsul("0", client))
+	require.NoError(t, registerServiceInConsul(1, serviceName, nil, client))
+	assert.Eventually(t, func() bool {
+		addr, err := resolver.Resolve(context.Background())
+		return err == nil && addr.Host == "service_1"
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// Make sure the agent actually served the blocking queries using streaming
+	served := backends.get()
+	require.NotEmpty(t, served)
+	for _, backend := range served {
+		assert.Equal(t, "streaming", backend)
+	}
+}
+
+// queryBackendRecorder records the backend the agent reports (in the X-Consul-Query-Backend header) for serving
+// every blocking health query
+type queryBackendRecorder struct {
+	next     http.RoundTripper
+	mu       sync.Mutex
+	backends []string
+}
+
+func (r *queryBackendRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.next.RoundTrip(req)
+	if err == nil && strings.HasPrefix(req.URL.Path, "/v1/health/service/") && req.URL.Query().Get("index") != "" {
+		r.mu.Lock()
+		r.backends = append(r.backends, resp.Header.Get("X-Consul-Query-Backend"))
+		r.mu.Unlock()
+	}
+	return resp, err
+}
+
+func (r *queryBackendRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.backends...)
+}
+
+// startLocalConsulAgent starts a Consul dev agent on random ports, and returns a client connected to it using the given transport
+func startLocalConsulAgent(t *testing.T, hcl string, transport http.RoundTripper) *api.Client {
+	bin, err := exec.LookPath("consul")
+	if err != nil {
+		t.Skip("consul binary not found in PATH")
+	}
+
+	ports := make([]int, 4)
+	for i := range ports {
+		ports[i] = getFreePort(t)
+	}
+
+	cmd := exec.Command(bin, "agent", "-dev", "-bind", "127.0.0.1", "-hcl", hcl, "-hcl", fmt.Sprintf(
+		"ports { http = %d, serf_lan = %d, serf_wan = %d, server = %d, dns = -1, grpc = -1 }",
+		ports[0], ports[1], ports[2], ports[3],
+	))
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	client, err := api.NewClient(&api.Config{
+		Address:    fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		HttpClient: &http.Client{Transport: transport},
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		leader, err := client.Status().Leader()
+		return err == nil && leader != ""
+	}, 30*time.Second, 100*time.Millisecond)
+
+	return client
+}
+
+func getFreePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
@@ -0,0 +1,42 @@
+package consulresolver
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/AppsFlyer/go-consul-resolver"
+
+// The attributes of the spans created by resolvers and transports
+const (
+	AttrServiceName  = attribute.Key("consul_resolver.service")
+	AttrInstanceID   = attribute.Key("consul_resolver.instance.id")
+	AttrNode         = attribute.Key("consul_resolver.instance.node")
+	AttrDatacenter   = attribute.Key("consul_resolver.instance.datacenter")
+	AttrBalancer     = attribute.Key("consul_resolver.balancer")
+	AttrRetryAttempt = attribute.Key("consul_resolver.retry_attempt")
+	AttrFallback     = attribute.Key("consul_resolver.fallback")
+)
+
+type retryAttemptKey struct{}
+
+// WithRetryAttempt returns a context marking the requests sent with it as the given retry attempt (0 for the first attempt),
+// which is recorded on the spans of LoadBalancedTransport round trips
+func WithRetryAttempt(ctx context.Context, attempt int) context.Context {
+	return context.WithValue(ctx, retryAttemptKey{}, attempt)
+}
+
+func retryAttempt(ctx context.Context) (int, bool) {
+	attempt, ok := ctx.Value(retryAttemptKey{}).(int)
+	return attempt, ok
+}
+
+// newTracer returns a tracer of the given provider, or a tracer that does not record spans if the provider is nil
+func newTracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
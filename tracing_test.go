@@ -0,0 +1,119 @@
+package consulresolver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTransportTracing(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	host, portStr, err := net.SplitHostPort(srv.Listener.Addr().String())
+	require.NoError(t, err)
+	port, _ := strconv.Atoi(portStr)
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	r, err := NewStaticResolver(context.Background(), ResolverConfig{
+		ServiceSpec:    ServiceSpec{ServiceName: "orders"},
+		WaitForReady:   true,
+		TracerProvider: tp,
+	}, StaticInstance{Address: host, Port: port, ID: "orders-1", Node: "node1"})
+	require.NoError(t, err)
+	defer r.Close()
+
+	transport, err := NewLoadBalancedTransport(TransportConfig{Resolvers: []Resolver{r}, TracerProvider: tp})
+	require.NoError(t, err)
+
+	req, err := http.NewRequestWithContext(WithRetryAttempt(context.Background(), 2), http.MethodGet, "http://orders/ping", nil)
+	require.NoError(t, err)
+	res, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	resolve, roundTrip := spans[0], spans[1]
+
+	assert.Equal(t, "consul_resolver.Resolve", resolve.Name())
+	assert.Equal(t, roundTrip.SpanContext().SpanID(), resolve.Parent().SpanID())
+	resolveAttrs := attributesOf(resolve.Attributes())
+	assert.Equal(t, "orders", resolveAttrs[AttrServiceName].AsString())
+	assert.Equal(t, "orders-1", resolveAttrs[AttrInstanceID].AsString())
+	assert.Equal(t, "node1", resolveAttrs[AttrNode].AsString())
+	assert.Equal(t, "*lb.RoundRobinLoadBalancer", resolveAttrs[AttrBalancer].AsString())
+
+	assert.Equal(t, "consul_resolver.RoundTrip", roundTrip.Name())
+	roundTripAttrs := attributesOf(roundTrip.Attributes())
+	assert.Equal(t, int64(2), roundTripAttrs[AttrRetryAttempt].AsInt64())
+	assert.False(t, roundTripAttrs[AttrFallback].AsBool())
+	assert.Equal(t, int64(http.StatusNoContent), roundTripAttrs["http.status_code"].AsInt64())
+	assert.Equal(t, codes.Unset, roundTrip.Status().Code)
+}
+
+func TestTransportTracingFallback(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	r, err := NewStaticResolver(context.Background(), ResolverConfig{
+		ServiceSpec:    ServiceSpec{ServiceName: "orders"},
+		TracerProvider: tp,
+	})
+	require.NoError(t, err)
+	r.Close()
+
+	transport, err := NewLoadBalancedTransport(TransportConfig{
+		Resolvers:           []Resolver{r},
+		TracerProvider:      tp,
+		NetResolverFallback: true,
+		Base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: req}, nil
+		}),
+	})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "http://orders/ping", nil)
+	require.NoError(t, err)
+	_, err = transport.RoundTrip(req)
+	require.NoError(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	resolve, roundTrip := spans[0], spans[1]
+	assert.Equal(t, codes.Error, resolve.Status().Code)
+	require.Len(t, resolve.Events(), 1)
+
+	attrs := attributesOf(roundTrip.Attributes())
+	assert.True(t, attrs[AttrFallback].AsBool())
+	_, ok := attrs[AttrRetryAttempt]
+	assert.False(t, ok)
+	assert.Equal(t, codes.Error, roundTrip.Status().Code)
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func attributesOf(kvs []attribute.KeyValue) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value, len(kvs))
+	for _, kv := range kvs {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
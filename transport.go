@@ -2,19 +2,26 @@ package consulresolver
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"crypto/tls"
 	"net"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/friendsofgo/errors"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ServiceAddress struct {
 	Host string
 	Port int
+	// ServerName is the TLS server name to use when connecting to the address.
+	// If empty, the transport will use the hostname of the original request.
+	ServerName string
 }
 
 type Resolver interface {
@@ -25,24 +32,53 @@ type Resolver interface {
 	ServiceName() string
 }
 
+// MultiResolver is implemented by resolvers that are able to return all the addresses of the service, e.g. for broadcasting
+type MultiResolver interface {
+	Resolver
+	// ResolveAll should return the addresses of all the service's targets, or a non-nil error if resolution failed
+	ResolveAll(context.Context) ([]ServiceAddress, error)
+}
+
+// DialFn is a function that establishes a connection to the given address, such as net.Dialer.DialContext
 type DialFn func(ctx context.Context, network, addr string) (net.Conn, error)
 
+const (
+	// tlsTransportIdleTTL is the duration after which an unused per server name transport is evicted
+	tlsTransportIdleTTL = 10 * time.Minute
+	// tlsTransportEvictInterval is the minimal interval between checks for idle per server name transports
+	tlsTransportEvictInterval = time.Minute
+)
+
 type LoadBalancedTransport struct {
-	resolvers        map[string]Resolver
+	// the time of the last check for idle TLS transports, in unix nanoseconds.
+	// Accessed atomically, and kept first for 64-bit alignment on 32-bit platforms.
+	lastTLSEviction  int64
+	resolvers        *resolverRegistry
 	base             http.RoundTripper
-	log              LogFn
+	logger           Logger
 	resolverFallback bool
+	metrics          Metrics
+	tracer           trace.Tracer
+	// tlsTransports holds a clone of the base transport per TLS server name, so that connections
+	// are pooled by both the server name and the resolved address. Clones that are not used for tlsTransportIdleTTL
+	// are evicted.
+	tlsTransports sync.Map
+}
+
+// tlsTransport is a clone of the base transport for a single TLS server name
+type tlsTransport struct {
+	// the time of the last request, in unix nanoseconds. Accessed atomically, and kept first for 64-bit alignment.
+	lastUsed int64
+	*http.Transport
 }
 
 func NewLoadBalancedTransport(conf TransportConfig) (*LoadBalancedTransport, error) {
 
-	if len(conf.Resolvers) == 0 {
+	if len(conf.Resolvers) == 0 && len(conf.HostResolvers) == 0 && conf.LazyResolvers == nil {
 		return nil, errors.New("no resolver provided")
 	}
 
-	if conf.Log == nil {
-		conf.Log = log.Printf
-	}
+	logger := withComponent(newLogger(conf.Logger, conf.Log), componentTransport)
 
 	var base http.RoundTripper
 	if conf.Base == nil {
@@ -51,43 +87,266 @@ func NewLoadBalancedTransport(conf TransportConfig) (*LoadBalancedTransport, err
 		base = conf.Base
 	}
 
-	resolvers := make(map[string]Resolver, len(conf.Resolvers))
-	for _, r := range conf.Resolvers {
-		resolvers[r.ServiceName()] = r
+	if conf.Metrics == nil {
+		conf.Metrics = noopMetrics{}
+	}
+
+	lazy, err := newLazyResolvers(conf.LazyResolvers, logger)
+	if err != nil {
+		return nil, err
 	}
 
 	return &LoadBalancedTransport{
-		resolvers:        resolvers,
+		resolvers:        newResolverRegistry(conf.Resolvers, conf.HostResolvers, conf.HostMatchers, lazy),
 		base:             base,
-		log:              conf.Log,
+		logger:           logger,
 		resolverFallback: conf.NetResolverFallback,
+		metrics:          conf.Metrics,
+		tracer:           newTracer(conf.TracerProvider),
 	}, nil
 }
 
 func (t *LoadBalancedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 
-	host := strings.Split(req.Host, ":")[0]
-	r, ok := t.resolvers[host]
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	r, ok := t.resolvers.lookup(req.Context(), host)
 	if !ok {
-		t.log("[LoadBalancedTransport] no resolver found for host %s", req.Host)
+		t.logger.Log(LevelDebug, "no resolver found for host", Field{Key: FieldHost, Value: host})
 		return t.base.RoundTrip(req)
 	}
 
-	tgt, err := r.Resolve(req.Context())
+	ctx, span := t.tracer.Start(req.Context(), "consul_resolver.RoundTrip", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		AttrServiceName.String(r.ServiceName()),
+		semconv.HTTPMethodKey.String(req.Method),
+	))
+	defer span.End()
+	if attempt, ok := retryAttempt(ctx); ok {
+		span.SetAttributes(AttrRetryAttempt.Int(attempt))
+	}
+	req = req.WithContext(ctx)
+
+	start := time.Now()
+	tgt, err := r.Resolve(ctx)
 	if err != nil {
-		t.log("[LoadBalancedTransport] failed resolving target - %s", err.Error())
 		if t.resolverFallback {
-			t.log("[LoadBalancedTransport] falling back to default resolver")
-			return t.base.RoundTrip(req)
+			t.logger.Log(LevelWarn, "failed resolving target, falling back to default resolver", serviceField(r.ServiceName()), errorField(err))
+			span.SetAttributes(AttrFallback.Bool(true))
+			res, err := t.base.RoundTrip(req)
+			t.metrics.RoundTrip(r.ServiceName(), RoundTripFallback, statusCodeOf(res), time.Since(start))
+			endRoundTripSpan(span, res, err)
+			return res, err
 		}
+		t.logger.Log(LevelError, "failed resolving target", serviceField(r.ServiceName()), errorField(err))
+		t.metrics.RoundTrip(r.ServiceName(), RoundTripResolveError, 0, time.Since(start))
+		endRoundTripSpan(span, nil, err)
+		return nil, err
+	}
+
+	if span.IsRecording() {
+		span.SetAttributes(
+			AttrFallback.Bool(false),
+			semconv.NetPeerNameKey.String(tgt.Host),
+			semconv.NetPeerPortKey.Int(tgt.Port),
+		)
+	}
+	res, err := t.roundTripTo(req, tgt)
+	outcome := RoundTripSuccess
+	if err != nil {
+		outcome = RoundTripError
+	}
+	t.metrics.RoundTrip(r.ServiceName(), outcome, statusCodeOf(res), time.Since(start))
+	endRoundTripSpan(span, res, err)
+	return res, err
+}
+
+// endRoundTripSpan records the result of a round trip on its span
+func endRoundTripSpan(span trace.Span, res *http.Response, err error) {
+	if !span.IsRecording() {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(res.StatusCode))
+	if res.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, http.StatusText(res.StatusCode))
+	}
+}
+
+func statusCodeOf(res *http.Response) int {
+	if res == nil {
+		return 0
+	}
+	return res.StatusCode
+}
+
+// BroadcastResult holds the outcome of a request sent to a single instance by Broadcast
+type BroadcastResult struct {
+	Address  ServiceAddress
+	Response *http.Response
+	Err      error
+}
+
+// Broadcast sends the request to every instance of the service matching the request's host, concurrently,
+// and returns the results of all the requests once they complete. The resolver must implement MultiResolver.
+// Requests with a body must have GetBody set (as done by http.NewRequest), so that the body can be sent to every instance.
+// The caller is responsible for closing the body of every successful response.
+func (t *LoadBalancedTransport) Broadcast(req *http.Request) ([]BroadcastResult, error) {
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	r, ok := t.resolvers.lookup(req.Context(), host)
+	if !ok {
+		return nil, errors.Errorf("no resolver found for host %s", host)
+	}
+
+	mr, ok := r.(MultiResolver)
+	if !ok {
+		return nil, errors.Errorf("resolver for host %s does not support resolving all addresses", host)
+	}
+
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return nil, errors.New("request body cannot be broadcast, GetBody must be set")
+	}
+
+	addrs, err := mr.ResolveAll(req.Context())
+	if err != nil {
 		return nil, err
 	}
 
+	results := make([]BroadcastResult, len(addrs))
+	wg := sync.WaitGroup{}
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr ServiceAddress) {
+			defer wg.Done()
+			results[i] = BroadcastResult{Address: addr}
+
+			cloned := req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					results[i].Err = err
+					return
+				}
+				cloned.Body = body
+			}
+			results[i].Response, results[i].Err = t.roundTripTo(cloned, addr)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+// roundTripTo sends the request to the given target address
+func (t *LoadBalancedTransport) roundTripTo(req *http.Request, tgt ServiceAddress) (*http.Response, error) {
 	// RoundTrip must not modify the original request - so we clone it
 	cloned := req.Clone(req.Context())
-	cloned.URL.Host = fmt.Sprintf("%s:%d", tgt.Host, tgt.Port)
+	cloned.URL.Host = net.JoinHostPort(tgt.Host, strconv.Itoa(tgt.Port))
 
-	return t.base.RoundTrip(cloned)
+	if req.URL.Scheme != "https" {
+		return t.base.RoundTrip(cloned)
+	}
+
+	serverName := tgt.ServerName
+	if serverName == "" {
+		serverName = req.URL.Hostname()
+	}
+	return t.tlsTransport(serverName).RoundTrip(cloned)
+}
+
+// AddResolver registers a resolver with the transport.
+// If a resolver with the same service name and datacenter is already registered, it is replaced, and closed if it implements io.Closer.
+// It is safe to call AddResolver concurrently with in-flight requests.
+func (t *LoadBalancedTransport) AddResolver(r Resolver) {
+	t.resolvers.add(r)
+}
+
+// RemoveResolver unregisters the given resolver, and closes it if it implements io.Closer.
+// It returns false if the resolver is not registered.
+// Resolvers are matched by identity, so resolvers of non-comparable types (e.g. structs holding a slice, rather than
+// pointers) cannot be removed.
+func (t *LoadBalancedTransport) RemoveResolver(r Resolver) bool {
+	return t.resolvers.remove(r)
+}
+
+// Resolvers returns all the resolvers registered with the transport, including the ones created on demand
+func (t *LoadBalancedTransport) Resolvers() []Resolver {
+	return t.resolvers.list()
+}
+
+// Close closes all the resolvers registered with the transport that implement io.Closer, including the ones created on demand,
+// as well as any idle connections. Requests made after Close will be delegated to the base transport.
+func (t *LoadBalancedTransport) Close() error {
+	t.resolvers.close()
+	t.CloseIdleConnections()
+	return nil
+}
+
+// CloseIdleConnections closes the idle connections of the base transport and of all the per server name transports
+func (t *LoadBalancedTransport) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+
+	if c, ok := t.base.(closeIdler); ok {
+		c.CloseIdleConnections()
+	}
+	t.tlsTransports.Range(func(_, v interface{}) bool {
+		v.(*tlsTransport).CloseIdleConnections()
+		return true
+	})
+}
+
+// tlsTransport returns a transport that verifies the server's certificate against the given server name.
+// The base transport is returned as is if it is not an *http.Transport, or if it already has a ServerName configured.
+func (t *LoadBalancedTransport) tlsTransport(serverName string) http.RoundTripper {
+	base, ok := t.base.(*http.Transport)
+	if !ok || (base.TLSClientConfig != nil && base.TLSClientConfig.ServerName != "") {
+		return t.base
+	}
+
+	now := time.Now()
+	if tr, ok := t.tlsTransports.Load(serverName); ok {
+		atomic.StoreInt64(&tr.(*tlsTransport).lastUsed, now.UnixNano())
+		return tr.(*tlsTransport).Transport
+	}
+	t.evictIdleTLSTransports(now)
+
+	tr := &tlsTransport{lastUsed: now.UnixNano(), Transport: base.Clone()}
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{} //nolint:gosec
+	}
+	tr.TLSClientConfig.ServerName = serverName
+
+	actual, _ := t.tlsTransports.LoadOrStore(serverName, tr)
+	return actual.(*tlsTransport).Transport
+}
+
+// evictIdleTLSTransports evicts the per server name transports that were not used for tlsTransportIdleTTL, closing their
+// idle connections. The transports are checked at most once per tlsTransportEvictInterval.
+func (t *LoadBalancedTransport) evictIdleTLSTransports(now time.Time) {
+	last := atomic.LoadInt64(&t.lastTLSEviction)
+	if now.Sub(time.Unix(0, last)) < tlsTransportEvictInterval || !atomic.CompareAndSwapInt64(&t.lastTLSEviction, last, now.UnixNano()) {
+		return
+	}
+
+	t.tlsTransports.Range(func(serverName, v interface{}) bool {
+		tr := v.(*tlsTransport)
+		if now.Sub(time.Unix(0, atomic.LoadInt64(&tr.lastUsed))) >= tlsTransportIdleTTL {
+			t.tlsTransports.Delete(serverName)
+			tr.CloseIdleConnections()
+		}
+		return true
+	})
 }
 
 func getDefaultTransport() *http.Transport {
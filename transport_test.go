@@ -2,9 +2,16 @@ package consulresolver
 
 import (
 	"context"
+	"crypto/tls"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/friendsofgo/errors"
 	"github.com/stretchr/testify/mock"
@@ -109,6 +116,169 @@ func (t *TestSuite) TestResolverFallbackOnError() {
 	t.resolver.AssertExpectations(t.T())
 }
 
+func (t *TestSuite) TestCloseClosesResolvers() {
+	closable := &closableResolver{staticNameResolver: staticNameResolver{name: serviceName}}
+
+	tr, err := NewLoadBalancedTransport(TransportConfig{
+		Resolvers: []Resolver{closable},
+	})
+	t.Require().NoError(err)
+
+	t.Assert().NoError(tr.Close())
+	t.Assert().True(closable.closed)
+	t.Assert().Empty(tr.Resolvers())
+}
+
+func (t *TestSuite) TestTLSServerNameFromRequestHost() {
+	srv, serverNames := startTLSServer(t)
+	defer srv.Close()
+
+	t.resolver.On("ServiceName").Return("example.com")
+	t.resolver.On("Resolve").Return(getServerAddress(t, srv, ""), nil)
+
+	tr, err := NewLoadBalancedTransport(TransportConfig{
+		Resolvers: []Resolver{t.resolver},
+		Base:      srv.Client().Transport,
+	})
+	t.Require().NoError(err)
+	client := &http.Client{Transport: tr}
+	res, err := client.Get("https://example.com/do/something")
+	t.Require().NoError(err)
+	res.Body.Close()
+
+	t.Assert().Equal(http.StatusOK, res.StatusCode)
+	t.Assert().Equal("example.com", <-serverNames)
+}
+
+func (t *TestSuite) TestTLSServerNameFromResolver() {
+	srv, serverNames := startTLSServer(t)
+	defer srv.Close()
+
+	t.resolver.On("ServiceName").Return(serviceName)
+	t.resolver.On("Resolve").Return(getServerAddress(t, srv, "example.com"), nil)
+
+	tr, err := NewLoadBalancedTransport(TransportConfig{
+		Resolvers: []Resolver{t.resolver},
+		Base:      srv.Client().Transport,
+	})
+	t.Require().NoError(err)
+	client := &http.Client{Transport: tr}
+	res, err := client.Get("https://test-service/do/something")
+	t.Require().NoError(err)
+	res.Body.Close()
+
+	t.Assert().Equal(http.StatusOK, res.StatusCode)
+	t.Assert().Equal("example.com", <-serverNames)
+}
+
+func (t *TestSuite) TestTLSTransportEviction() {
+	t.resolver.On("ServiceName").Return(serviceName)
+	tr, err := NewLoadBalancedTransport(TransportConfig{
+		Resolvers: []Resolver{t.resolver},
+		Base:      &http.Transport{},
+	})
+	t.Require().NoError(err)
+
+	idle := tr.tlsTransport("idle.example.com")
+	t.Assert().Same(idle, tr.tlsTransport("idle.example.com"))
+	t.Assert().Equal("idle.example.com", idle.(*http.Transport).TLSClientConfig.ServerName)
+
+	// transports that were not used for the idle TTL are evicted once a new server name is used
+	v, _ := tr.tlsTransports.Load("idle.example.com")
+	atomic.StoreInt64(&v.(*tlsTransport).lastUsed, time.Now().Add(-tlsTransportIdleTTL).UnixNano())
+	atomic.StoreInt64(&tr.lastTLSEviction, 0)
+	tr.tlsTransport("active.example.com")
+
+	_, ok := tr.tlsTransports.Load("idle.example.com")
+	t.Assert().False(ok)
+	_, ok = tr.tlsTransports.Load("active.example.com")
+	t.Assert().True(ok)
+}
+
+type MockMultiResolver struct {
+	MockResolver
+}
+
+func (m *MockMultiResolver) ResolveAll(context.Context) ([]ServiceAddress, error) {
+	args := m.Called()
+	return args.Get(0).([]ServiceAddress), args.Error(1)
+}
+
+func (t *TestSuite) TestBroadcast() {
+	var addrs []ServiceAddress
+	for i := 0; i < 3; i++ {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			_, _ = w.Write(body)
+		}))
+		defer srv.Close()
+		addrs = append(addrs, getServerAddress(t, srv, ""))
+	}
+
+	resolver := &MockMultiResolver{}
+	resolver.On("ServiceName").Return(serviceName)
+	resolver.On("ResolveAll").Return(addrs, nil)
+
+	tr, err := NewLoadBalancedTransport(TransportConfig{
+		Resolvers: []Resolver{resolver},
+	})
+	t.Require().NoError(err)
+
+	req, err := http.NewRequest(http.MethodPost, "http://test-service/invalidate", strings.NewReader("key"))
+	t.Require().NoError(err)
+	results, err := tr.Broadcast(req)
+	t.Require().NoError(err)
+	t.Require().Len(results, 3)
+
+	for i, res := range results {
+		t.Require().NoError(res.Err)
+		body, err := io.ReadAll(res.Response.Body)
+		res.Response.Body.Close()
+		t.Require().NoError(err)
+		t.Assert().Equal("key", string(body))
+		t.Assert().Equal(addrs[i], res.Address)
+	}
+}
+
+func (t *TestSuite) TestBroadcastUnsupportedResolver() {
+	t.resolver.On("ServiceName").Return(serviceName)
+
+	tr, err := NewLoadBalancedTransport(TransportConfig{
+		Resolvers: []Resolver{t.resolver},
+	})
+	t.Require().NoError(err)
+
+	req, err := http.NewRequest(http.MethodGet, "http://test-service/invalidate", nil)
+	t.Require().NoError(err)
+	_, err = tr.Broadcast(req)
+	t.Assert().Error(err)
+}
+
+// startTLSServer starts a TLS server with a certificate valid for example.com,
+// and returns a channel that receives the server name of every TLS handshake
+func startTLSServer(t *TestSuite) (*httptest.Server, chan string) {
+	serverNames := make(chan string, 10)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	}
+	srv.StartTLS()
+	return srv, serverNames
+}
+
+func getServerAddress(t *TestSuite, srv *httptest.Server, serverName string) ServiceAddress {
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	t.Require().NoError(err)
+	p, err := strconv.Atoi(port)
+	t.Require().NoError(err)
+	return ServiceAddress{Host: host, Port: p, ServerName: serverName}
+}
+
 func getAssertableTransport(t *TestSuite, shouldInvoke bool) *http.Transport {
 	base := http.DefaultTransport.(*http.Transport).Clone()
 	baseDialCtx := base.DialContext
@@ -0,0 +1,336 @@
+package consulresolver
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/hashicorp/consul/api"
+	"go.uber.org/ratelimit"
+)
+
+// watchSubscriber receives the results of a watcher
+type watchSubscriber interface {
+	// onUpdate is called with every successful response from the discovery backend.
+	// The entries slice is owned by the subscriber, while the entries themselves are shared and must not be modified.
+	// meta is nil for backends other than Consul.
+	onUpdate(entries []*api.ServiceEntry, meta *api.QueryMeta)
+	// onError is called whenever querying the discovery backend fails
+	onError(err error)
+}
+
+// watcher watches the instances of a service in a single datacenter, and fans the results out to its subscribers
+type watcher struct {
+	discovery Discovery
+	req       DiscoveryRequest
+	logger    Logger
+	metrics   Metrics
+
+	mu          sync.Mutex
+	subscribers map[uint64]*watchSubscription
+	nextID      uint64
+	version     uint64 // incremented on every response, 0 until the first one
+	last        []*api.ServiceEntry
+	lastMeta    *api.QueryMeta
+}
+
+// watchSubscription serializes the callbacks of a single subscriber, which are called outside of the watcher's lock
+type watchSubscription struct {
+	watchSubscriber
+	mu      sync.Mutex
+	version uint64 // the version of the last response delivered to the subscriber
+}
+
+// update delivers the response of the given version, unless a newer one was already delivered
+func (s *watchSubscription) update(version uint64, entries []*api.ServiceEntry, meta *api.QueryMeta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version <= s.version {
+		return
+	}
+	s.version = version
+	s.onUpdate(copyEntries(entries), meta)
+}
+
+func (s *watchSubscription) error(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onError(err)
+}
+
+func newWatcher(discovery Discovery, spec ServiceSpec, datacenter string, logger Logger, metrics Metrics) *watcher {
+	return &watcher{
+		discovery: discovery,
+		req: DiscoveryRequest{
+			ServiceName:      spec.ServiceName,
+			Tags:             spec.Tags,
+			IncludeUnhealthy: spec.IncludeUnhealthy,
+			Datacenter:       datacenter,
+		},
+		logger:      logger,
+		metrics:     metrics,
+		subscribers: map[uint64]*watchSubscription{},
+	}
+}
+
+// subscribe adds a subscriber, immediately delivering the last response if one was received
+func (w *watcher) subscribe(s watchSubscriber) uint64 {
+	id := w.add(s)
+	w.replay(id)
+	return id
+}
+
+// add adds a subscriber without delivering the last response, which is done by replay
+func (w *watcher) add(s watchSubscriber) uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	id := w.nextID
+	w.nextID++
+	w.subscribers[id] = &watchSubscription{watchSubscriber: s}
+	return id
+}
+
+// replay delivers the last response to the given subscriber, if one was received
+func (w *watcher) replay(id uint64) {
+	w.mu.Lock()
+	sub, ok := w.subscribers[id]
+	version, last, lastMeta := w.version, w.last, w.lastMeta
+	w.mu.Unlock()
+
+	if ok && version > 0 {
+		sub.update(version, last, lastMeta)
+	}
+}
+
+// unsubscribe removes a subscriber, and returns the number of remaining subscribers
+func (w *watcher) unsubscribe(id uint64) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.subscribers, id)
+	return len(w.subscribers)
+}
+
+// run queries the discovery backend until the context is done
+func (w *watcher) run(ctx context.Context) {
+	rl := ratelimit.New(1) // limit queries to 1 per second
+	bck := backoff.NewExponentialBackOff()
+	bck.MaxElapsedTime = 0
+	bck.MaxInterval = time.Second * 30
+
+	req := w.req
+	for ctx.Err() == nil {
+		rl.Take()
+		if ctx.Err() != nil {
+			break
+		}
+		attempt := 0
+		err := backoff.RetryNotify(
+			func() error {
+				attempt++
+				start := time.Now()
+				err := w.query(ctx, &req)
+				if ctx.Err() == nil {
+					w.metrics.DiscoveryQuery(w.req.ServiceName, w.req.Datacenter, time.Since(start), err)
+				}
+				return err
+			},
+			backoff.WithContext(bck, ctx),
+			func(err error, duration time.Duration) {
+				w.notifyError(err)
+				w.metrics.DiscoveryBackoff(w.req.ServiceName, w.req.Datacenter, duration)
+				w.logger.Log(LevelWarn, "failure querying service",
+					serviceField(w.req.ServiceName), datacenterField(w.req.Datacenter),
+					Field{Key: FieldAttempt, Value: attempt}, Field{Key: FieldBackoff, Value: duration}, errorField(err))
+			},
+		)
+		if err != nil && ctx.Err() == nil {
+			w.notifyError(err)
+			w.logger.Log(LevelError, "failure querying service", serviceField(w.req.ServiceName), datacenterField(w.req.Datacenter), errorField(err))
+		}
+	}
+	w.logger.Log(LevelDebug, "context canceled, stopping watcher", serviceField(w.req.ServiceName), datacenterField(w.req.Datacenter))
+}
+
+// query performs a single (blocking) query, and notifies the subscribers of the result
+func (w *watcher) query(ctx context.Context, req *DiscoveryRequest) error {
+	res, err := w.discovery.Watch(ctx, *req)
+	if err != nil {
+		return err
+	}
+
+	if res.Index < req.WaitIndex {
+		req.WaitIndex = 0
+	} else {
+		req.WaitIndex = uint64(math.Max(float64(1), float64(res.Index)))
+	}
+
+	w.mu.Lock()
+	w.version++
+	version := w.version
+	w.last, w.lastMeta = res.Instances, res.QueryMeta
+	subscribers := w.subscriptions()
+	w.mu.Unlock()
+
+	fanOut(subscribers, func(s *watchSubscription) {
+		s.update(version, res.Instances, res.QueryMeta)
+	})
+	return nil
+}
+
+func (w *watcher) notifyError(err error) {
+	w.mu.Lock()
+	subscribers := w.subscriptions()
+	w.mu.Unlock()
+
+	fanOut(subscribers, func(s *watchSubscription) {
+		s.error(err)
+	})
+}
+
+// subscriptions returns the current subscribers, the caller must hold the lock
+func (w *watcher) subscriptions() []*watchSubscription {
+	res := make([]*watchSubscription, 0, len(w.subscribers))
+	for _, s := range w.subscribers {
+		res = append(res, s)
+	}
+	return res
+}
+
+// fanOut calls fn for every subscriber concurrently, so that a slow subscriber does not delay the others of a shared
+// watch, and waits for all of them to return
+func fanOut(subscribers []*watchSubscription, fn func(*watchSubscription)) {
+	if len(subscribers) == 1 {
+		fn(subscribers[0])
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	for _, s := range subscribers {
+		wg.Add(1)
+		go func(s *watchSubscription) {
+			defer wg.Done()
+			fn(s)
+		}(s)
+	}
+	wg.Wait()
+}
+
+func copyEntries(se []*api.ServiceEntry) []*api.ServiceEntry {
+	if se == nil {
+		return nil
+	}
+	res := make([]*api.ServiceEntry, len(se))
+	copy(res, se)
+	return res
+}
+
+// WatcherPool deduplicates the watches of resolvers querying the same service, tags, health, datacenter and query options (e.g. filter and node meta).
+// A single go routine is run per unique watch, and its results are fanned out to all the subscribed resolvers.
+// The go routine is stopped once the last subscribed resolver is closed, or its context is done.
+// Custom Discovery implementations are only shared if they are comparable (e.g. pointers).
+// As the queries of a shared watch are reported once, watches are only shared by resolvers reporting to the same Metrics,
+// which must be comparable as well.
+type WatcherPool struct {
+	mu       sync.Mutex
+	watchers map[watchKey]*pooledWatcher
+}
+
+type pooledWatcher struct {
+	*watcher
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type watchKey struct {
+	discovery   interface{}
+	service     string
+	tags        string
+	passingOnly bool
+	datacenter  string
+	metrics     Metrics
+}
+
+// NewWatcherPool creates a new, empty, WatcherPool
+func NewWatcherPool() *WatcherPool {
+	return &WatcherPool{watchers: map[watchKey]*pooledWatcher{}}
+}
+
+// newWatchKey returns the key identifying the watcher in a pool, or false if the watcher cannot be shared
+func newWatchKey(w *watcher) (watchKey, bool) {
+	var discovery interface{} = w.discovery
+	if k, ok := w.discovery.(interface{ watchKey() interface{} }); ok {
+		discovery = k.watchKey()
+	} else if !reflect.TypeOf(w.discovery).Comparable() {
+		return watchKey{}, false
+	}
+	if w.metrics != nil && !reflect.TypeOf(w.metrics).Comparable() {
+		return watchKey{}, false
+	}
+
+	tags := append([]string(nil), w.req.Tags...)
+	sort.Strings(tags)
+
+	return watchKey{
+		discovery:   discovery,
+		service:     w.req.ServiceName,
+		tags:        strings.Join(tags, "\x00"),
+		passingOnly: !w.req.IncludeUnhealthy,
+		datacenter:  w.req.Datacenter,
+		metrics:     w.metrics,
+	}, true
+}
+
+// subscribe subscribes to a watcher equivalent to the given one, starting it if no such watcher is running.
+// The returned function unsubscribes, and stops the watcher if no subscribers are left.
+func (p *WatcherPool) subscribe(w *watcher, s watchSubscriber) (unsubscribe func()) {
+	key, shared := newWatchKey(w)
+
+	p.mu.Lock()
+	pw, ok := p.watchers[key]
+	if !ok || !shared {
+		ctx, cancel := context.WithCancel(context.Background())
+		pw = &pooledWatcher{watcher: w, cancel: cancel, done: make(chan struct{})}
+		if shared {
+			p.watchers[key] = pw
+		}
+		go func() {
+			defer close(pw.done)
+			pw.run(ctx)
+		}()
+	}
+	id := pw.add(s)
+	p.mu.Unlock()
+
+	// deliver the last response outside of the pool's lock, as the subscriber may be slow
+	pw.replay(id)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			remaining := pw.unsubscribe(id)
+			if remaining == 0 && shared && p.watchers[key] == pw {
+				delete(p.watchers, key)
+			}
+			p.mu.Unlock()
+
+			if remaining == 0 {
+				pw.cancel()
+				<-pw.done
+			}
+		})
+	}
+}
+
+func (p *WatcherPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.watchers)
+}
@@ -0,0 +1,235 @@
+package consulresolver
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AppsFlyer/go-consul-resolver/lb"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatcherPoolSharesWatches(t *testing.T) {
+	client, fake := newFakeConsulClient(t)
+	pool := NewWatcherPool()
+
+	newResolver := func(tags []string, balancer Balancer) *ServiceResolver {
+		r, err := NewConsulResolver(context.Background(), ResolverConfig{
+			ServiceSpec:  ServiceSpec{ServiceName: "service", Tags: tags},
+			Client:       client,
+			Balancer:     balancer,
+			WatcherPool:  pool,
+			WaitForReady: true,
+		})
+		require.NoError(t, err)
+		return r
+	}
+
+	roundRobin := newResolver([]string{"a", "b"}, &lb.RoundRobinLoadBalancer{})
+	tagAware := newResolver([]string{"b", "a"}, &lb.TagAwareLoadBalancer{FallbackAllowed: true})
+	assert.Equal(t, 1, pool.size())
+
+	for _, r := range []*ServiceResolver{roundRobin, tagAware} {
+		addr, err := r.Resolve(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, ServiceAddress{Host: "10.0.0.1", Port: 8080}, addr)
+	}
+
+	other := newResolver([]string{"c"}, nil)
+	assert.Equal(t, 2, pool.size())
+	watchers := pool.pooledWatchers()
+
+	require.NoError(t, other.Close())
+	require.NoError(t, roundRobin.Close())
+	assert.Equal(t, 1, pool.size())
+
+	// the shared watch keeps serving the remaining resolver
+	_, err := tagAware.Resolve(context.Background())
+	assert.NoError(t, err)
+
+	require.NoError(t, tagAware.Close())
+	assert.Equal(t, 0, pool.size())
+	assertWatchersStopped(t, watchers)
+	assert.Greater(t, fake.queriesFor("service@"), 0)
+}
+
+// pooledWatchers returns the watchers currently running in the pool
+func (p *WatcherPool) pooledWatchers() []*pooledWatcher {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make([]*pooledWatcher, 0, len(p.watchers))
+	for _, pw := range p.watchers {
+		res = append(res, pw)
+	}
+	return res
+}
+
+func assertWatchersStopped(t *testing.T, watchers []*pooledWatcher) {
+	t.Helper()
+	for _, pw := range watchers {
+		select {
+		case <-pw.done:
+		default:
+			t.Errorf("watcher of %s should be stopped", pw.req.ServiceName)
+		}
+	}
+}
+
+// countingMetrics counts the discovery queries it receives
+type countingMetrics struct {
+	noopMetrics
+	queries int64
+}
+
+func (m *countingMetrics) DiscoveryQuery(string, string, time.Duration, error) {
+	atomic.AddInt64(&m.queries, 1)
+}
+
+func TestWatcherPoolSharesWatchesByMetrics(t *testing.T) {
+	client, _ := newFakeConsulClient(t)
+	pool := NewWatcherPool()
+
+	newResolver := func(metrics Metrics) *ServiceResolver {
+		r, err := NewConsulResolver(context.Background(), ResolverConfig{
+			ServiceSpec:  ServiceSpec{ServiceName: "service"},
+			Client:       client,
+			Metrics:      metrics,
+			WatcherPool:  pool,
+			WaitForReady: true,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+
+	// every resolver's metrics receive the queries of its watch
+	shared, other := &countingMetrics{}, &countingMetrics{}
+	newResolver(shared)
+	newResolver(shared)
+	assert.Equal(t, 1, pool.size())
+	newResolver(other)
+	assert.Equal(t, 2, pool.size())
+	assert.Greater(t, atomic.LoadInt64(&shared.queries), int64(0))
+	assert.Greater(t, atomic.LoadInt64(&other.queries), int64(0))
+}
+
+func TestWatcherPoolStopsWatchesOfCanceledResolvers(t *testing.T) {
+	client, _ := newFakeConsulClient(t)
+	pool := NewWatcherPool()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := NewConsulResolver(ctx, ResolverConfig{
+		ServiceSpec:  ServiceSpec{ServiceName: "service"},
+		Client:       client,
+		WatcherPool:  pool,
+		WaitForReady: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, pool.size())
+	watchers := pool.pooledWatchers()
+
+	cancel()
+	// the resolver unsubscribes once its context is done, and Close waits for it
+	require.NoError(t, r.Close())
+	assert.Equal(t, 0, pool.size())
+	assertWatchersStopped(t, watchers)
+}
+
+type recordingSubscriber struct {
+	updates chan []*api.ServiceEntry
+}
+
+func (s *recordingSubscriber) onUpdate(se []*api.ServiceEntry, _ *api.QueryMeta) {
+	s.updates <- se
+}
+
+func (s *recordingSubscriber) onError(error) {}
+
+func TestWatcherDeliversLastResultToNewSubscribers(t *testing.T) {
+	entries := []*api.ServiceEntry{{Node: &api.Node{ID: "1"}, Service: &api.AgentService{ID: "1"}}}
+	w := newWatcher(newConsulDiscovery(&MockClient{services: entries}, nil, api.QueryOptions{}, 0), ServiceSpec{ServiceName: "service"}, "", LogFnLogger{Fn: t.Logf}, noopMetrics{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	first := &recordingSubscriber{updates: make(chan []*api.ServiceEntry, 10)}
+	w.subscribe(first)
+	assert.Equal(t, entries, <-first.updates)
+
+	second := &recordingSubscriber{updates: make(chan []*api.ServiceEntry, 10)}
+	w.subscribe(second)
+	select {
+	case se := <-second.updates:
+		assert.Equal(t, entries, se)
+	default:
+		t.Fatal("new subscriber should receive the last result immediately")
+	}
+}
+
+// blockingSubscriber blocks in onUpdate until released
+type blockingSubscriber struct {
+	received chan struct{}
+	release  chan struct{}
+}
+
+func (s *blockingSubscriber) onUpdate([]*api.ServiceEntry, *api.QueryMeta) {
+	select {
+	case s.received <- struct{}{}:
+	default:
+	}
+	<-s.release
+}
+
+func (s *blockingSubscriber) onError(error) {}
+
+func TestWatcherSlowSubscriber(t *testing.T) {
+	entries := []*api.ServiceEntry{{Node: &api.Node{ID: "1"}, Service: &api.AgentService{ID: "1"}}}
+	w := newWatcher(newConsulDiscovery(&MockClient{services: entries}, nil, api.QueryOptions{}, 0), ServiceSpec{ServiceName: "service"}, "", LogFnLogger{Fn: t.Logf}, noopMetrics{})
+
+	slow := &blockingSubscriber{received: make(chan struct{}, 1), release: make(chan struct{})}
+	fast := &recordingSubscriber{updates: make(chan []*api.ServiceEntry, 10)}
+	w.subscribe(slow)
+	w.subscribe(fast)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.run(ctx)
+	}()
+	defer func() {
+		close(slow.release)
+		cancel()
+		<-done
+	}()
+
+	<-slow.received
+	select {
+	case se := <-fast.updates:
+		assert.Equal(t, entries, se)
+	case <-time.After(time.Second):
+		t.Fatal("subscribers should not be delayed by a slow subscriber")
+	}
+
+	// subscribing does not wait for the slow subscriber either
+	late := &recordingSubscriber{updates: make(chan []*api.ServiceEntry, 10)}
+	id := w.subscribe(late)
+	select {
+	case se := <-late.updates:
+		assert.Equal(t, entries, se)
+	default:
+		t.Fatal("new subscriber should receive the last result immediately")
+	}
+	assert.Equal(t, 2, w.unsubscribe(id))
+}